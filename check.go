@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// lints a k9 config and all the pruning configs it references, e.g. before
+// deploying them; unlike the service, it parses strictly and reports all the
+// problems it finds instead of skipping broken files
+type configChecker struct {
+	problems []string
+}
+
+// prints the problems found, and returns how many there are
+func check(writer io.Writer, path string) int {
+	// all the warnings we care about get reported as problems
+	previousLevel := setLogLevel(ERROR)
+	defer setLogLevel(previousLevel)
+
+	checker := &configChecker{}
+	checker.checkConfig(path)
+
+	for _, problem := range checker.problems {
+		fmt.Fprintln(writer, problem)
+	}
+	if len(checker.problems) == 0 {
+		fmt.Fprintf(writer, "No problems found in %v\n", path)
+	} else {
+		fmt.Fprintf(writer, "%v problem(s) found in %v\n", len(checker.problems), path)
+	}
+
+	return len(checker.problems)
+}
+
+func (checker *configChecker) report(format string, v ...interface{}) {
+	checker.problems = append(checker.problems, fmt.Sprintf(format, v...))
+}
+
+func (checker *configChecker) checkConfig(path string) {
+	rawContent, err := ioutil.ReadFile(path)
+	if err != nil {
+		checker.report("Unable to read the config at %v: %v", path, err)
+		return
+	}
+	if !checker.decodeStrictly(rawContent, path, &configFileContent{}) {
+		return
+	}
+	// values get interpolated and parsed exactly the same way as by the service
+	document, err := parseAndInterpolate(rawContent, path)
+	if err != nil {
+		checker.report("%v", err)
+		return
+	}
+	content, err := parseConfigFileContent(document)
+	if err != nil {
+		checker.report("Unable to parse %v: %v", path, err)
+		return
+	}
+
+	// secrets themselves don't get loaded, since they might not be available
+	// wherever configs get checked
+	for _, err := range []error{
+		checkSecretSources("api_key", content.Api_key, content.Api_key_file, content.Api_key_command),
+		checkSecretSources("application_key", content.Application_key, content.Application_key_file, content.Application_key_command),
+	} {
+		if err != nil {
+			checker.report("%v: %v", path, err)
+		}
+	}
+	if content.Log_level != "" && parseLogLevel(content.Log_level) == -1 {
+		checker.report("%v: unknown log level: %v", path, content.Log_level)
+	}
+	if content.Gauge_aggregation != "" && !isValidAggregation(content.Gauge_aggregation) {
+		checker.report("%v: unknown gauge aggregation: %v", path, content.Gauge_aggregation)
+	}
+
+	pruningConfig := NewPruningConfig()
+	if content.Rule_precedence != "" {
+		if isValidRulePrecedence(content.Rule_precedence) {
+			pruningConfig.rulePrecedence = content.Rule_precedence
+		} else {
+			checker.report("%v: unknown rule precedence: %v", path, content.Rule_precedence)
+		}
+	}
+
+	pruningContents := []*pruningConfigFileContent{}
+	for _, filenameOrGlob := range content.Pruning_configs {
+		if isRemotePruningConfig(filenameOrGlob) {
+			if pruningContent := checker.checkRemotePruningConfig(pruningConfig, filenameOrGlob); pruningContent != nil {
+				pruningContents = append(pruningContents, pruningContent)
+			}
+			continue
+		}
+
+		for _, filename := range checker.pruningConfigFiles(path, filenameOrGlob) {
+			if pruningContent := checker.checkPruningConfig(pruningConfig, filename); pruningContent != nil {
+				pruningContents = append(pruningContents, pruningContent)
+			}
+		}
+	}
+
+	for _, conflict := range pruningConfig.conflicts {
+		checker.report("%v", conflict)
+	}
+	checker.checkKeepRules(pruningContents)
+	checker.checkExpiredRules(pruningContents, time.Now())
+}
+
+// same logic as MergeWithFileOrGlob
+func (checker *configChecker) pruningConfigFiles(path, filenameOrGlob string) []string {
+	if _, err := os.Stat(filenameOrGlob); err == nil {
+		return []string{filenameOrGlob}
+	}
+
+	matches, err := filepath.Glob(filenameOrGlob)
+	if err != nil || len(matches) == 0 {
+		checker.report("%v: no pruning config found at %v", path, filenameOrGlob)
+	}
+	return matches
+}
+
+// returns nil if the file couldn't be loaded
+func (checker *configChecker) checkPruningConfig(pruningConfig *PruningConfig, filename string) *pruningConfigFileContent {
+	rawContent, err := ioutil.ReadFile(filename)
+	if err != nil {
+		checker.report("Unable to read pruning config %v: %v", filename, err)
+		return nil
+	}
+	if !checker.decodeStrictly(rawContent, filename, &pruningConfigFileContent{}) {
+		return nil
+	}
+	document, err := parseAndInterpolate(rawContent, filename)
+	if err != nil {
+		checker.report("%v", err)
+		return nil
+	}
+
+	return checker.mergePruningConfig(pruningConfig, document, filename)
+}
+
+// unlike the service, never falls back to a cached version
+func (checker *configChecker) checkRemotePruningConfig(pruningConfig *PruningConfig, url string) *pruningConfigFileContent {
+	remotes := NewRemotePruningConfigs()
+	source := remotes.source(url)
+	if _, err := remotes.update(source); err != nil {
+		checker.report("Unable to fetch pruning config from %v: %v", url, err)
+		return nil
+	}
+
+	if !checker.decodeStrictly(source.content, url, &pruningConfigFileContent{}) {
+		return nil
+	}
+	document := &yaml.Node{}
+	if err := yaml.Unmarshal(source.content, document); err != nil {
+		checker.report("Unable to parse %v: %v", url, err)
+		return nil
+	}
+
+	return checker.mergePruningConfig(pruningConfig, document, url)
+}
+
+func (checker *configChecker) mergePruningConfig(pruningConfig *PruningConfig, document *yaml.Node, name string) *pruningConfigFileContent {
+	content, err := decodePruningConfig(document, name)
+	if err == nil {
+		err = pruningConfig.merge(content)
+	}
+	if err != nil {
+		checker.report("Unable to load pruning config from %v: %v", name, err)
+		return nil
+	}
+
+	return content
+}
+
+// reports unknown keys, e.g. `host_tag` instead of `host_tags`, and duplicate
+// keys, using the same YAML library as the service; returns false if the
+// service wouldn't be able to parse the file either. Values of the wrong type
+// only get reported once interpolated, since e.g. `${PORT}` is a fine port
+func (checker *configChecker) decodeStrictly(rawContent []byte, filename string, out interface{}) bool {
+	err := yamlv2.UnmarshalStrict(rawContent, out)
+	if err == nil {
+		return true
+	}
+
+	typeError, ok := err.(*yamlv2.TypeError)
+	if !ok {
+		checker.report("Unable to parse %v: %v", filename, err)
+		return false
+	}
+
+	for _, message := range typeError.Errors {
+		// messages are of the form `line 5: field host_tag not found in type main.pruningConfigFileContentTagsConfig`
+		line, message := "?", strings.TrimPrefix(message, "line ")
+		if split := strings.SplitN(message, ": ", 2); len(split) == 2 {
+			line, message = split[0], split[1]
+		}
+		switch {
+		case strings.HasPrefix(message, "field ") && strings.Contains(message, " not found in type "):
+			message = "unknown key " + strings.TrimPrefix(message[:strings.Index(message, " not found in type ")], "field ")
+		case strings.HasPrefix(message, "field ") && strings.Contains(message, " already set in type "):
+			message = "duplicate key " + strings.TrimPrefix(message[:strings.Index(message, " already set in type ")], "field ") + ", the last one wins"
+		case strings.HasPrefix(message, "key ") && strings.HasSuffix(message, " already set in map"):
+			message = "duplicate key " + strings.TrimSuffix(strings.TrimPrefix(message, "key "), " already set in map") + ", the last one wins"
+		default:
+			continue
+		}
+		checker.report("%v:%v: %v", filename, line, message)
+	}
+	return true
+}
+
+// reports `keep` rules that can't override any `remove` rule, across all the
+// pruning configs, since those are most likely mistakes
+func (checker *configChecker) checkKeepRules(contents []*pruningConfigFileContent) {
+	// metric patterns that remove metrics, and tag rules that remove tags
+	removedMetrics := []string{}
+	removedTags := []pruningConfigFileContentTagsConfig{}
+	for _, content := range contents {
+		removedMetrics = append(removedMetrics, content.Metrics.Remove...)
+		for _, allowConfig := range content.Metrics.Allow {
+			removedMetrics = append(removedMetrics, allowConfig.Namespace)
+		}
+		for _, conditionalConfig := range content.Metrics.Remove_if {
+			removedMetrics = append(removedMetrics, conditionalConfig.Metrics...)
+		}
+
+		removedTags = append(removedTags, content.Tags.Remove...)
+		for _, onlyConfig := range content.Tags.Only {
+			// tag allowlists remove any tag not listed
+			removedTags = append(removedTags, pruningConfigFileContentTagsConfig{
+				Metrics: onlyConfig.Metrics,
+				Tags:    []string{"*"},
+			})
+		}
+	}
+
+	for _, content := range contents {
+		for i, metric := range content.Metrics.Keep {
+			if !anyMetricPatternsOverlap([]string{metric}, removedMetrics) {
+				checker.report("%v: keep rule for %v never overrides any remove rule", content.sourceOf("metrics.keep", i), metric)
+			}
+		}
+
+		for i, keepConfig := range content.Tags.Keep {
+			if !keepConfig.overridesAny(removedTags) {
+				checker.report("%v: keep rule for tags %v on %v never overrides any remove rule",
+					content.sourceOf("tags.keep", i), keepConfig.Tags, keepConfig.Metrics)
+			}
+		}
+	}
+}
+
+// expired rules are most likely leftovers that should be cleaned up
+func (checker *configChecker) checkExpiredRules(contents []*pruningConfigFileContent, now time.Time) {
+	for _, content := range contents {
+		if content.When != nil && content.When.expiredAt(now) {
+			checker.report("%v: rules expired on %v", content.filename, content.When.Expires)
+		}
+
+		for section, tagsConfigs := range map[string][]pruningConfigFileContentTagsConfig{
+			"tags.remove": content.Tags.Remove,
+			"tags.keep":   content.Tags.Keep,
+			"tags.only":   content.Tags.Only,
+			"tags.add":    content.Tags.Add,
+		} {
+			for i, tagsConfig := range tagsConfigs {
+				if tagsConfig.When != nil && tagsConfig.When.expiredAt(now) {
+					checker.report("%v: rule expired on %v", content.sourceOf(section, i), tagsConfig.When.Expires)
+				}
+			}
+		}
+	}
+}
+
+func (keepConfig *pruningConfigFileContentTagsConfig) overridesAny(removeConfigs []pruningConfigFileContentTagsConfig) bool {
+	for _, removeConfig := range removeConfigs {
+		if !anyMetricPatternsOverlap(keepConfig.Metrics, removeConfig.Metrics) {
+			continue
+		}
+		if keepConfig.Host_tags && removeConfig.Host_tags {
+			return true
+		}
+		for _, keptTag := range keepConfig.Tags {
+			for _, removedTag := range removeConfig.Tags {
+				if tagPatternsOverlap(keptTag, removedTag) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func anyMetricPatternsOverlap(patterns, otherPatterns []string) bool {
+	for _, pattern := range patterns {
+		for _, otherPattern := range otherPatterns {
+			if metricPatternsOverlap(pattern, otherPattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// whether some metric could match both patterns; errs on the side of caution,
+// i.e. regular expressions are assumed to overlap with anything
+func metricPatternsOverlap(pattern, otherPattern string) bool {
+	if isRegexPattern(pattern) || isRegexPattern(otherPattern) {
+		return true
+	}
+	return pathsOverlap(strings.Split(pattern, "."), strings.Split(otherPattern, "."))
+}
+
+func pathsOverlap(path, otherPath []string) bool {
+	if len(path) == 0 || len(otherPath) == 0 {
+		return len(path) == 0 && len(otherPath) == 0
+	}
+	if !segmentsOverlap(path[0], otherPath[0]) {
+		return false
+	}
+
+	// both patterns consume one segment; `**` can then either go on matching
+	// more segments, or stop there
+	if pathsOverlap(path[1:], otherPath[1:]) {
+		return true
+	}
+	if path[0] == "**" && pathsOverlap(path, otherPath[1:]) {
+		return true
+	}
+	return otherPath[0] == "**" && pathsOverlap(path[1:], otherPath)
+}
+
+func segmentsOverlap(segment, otherSegment string) bool {
+	switch {
+	case segment == "*", segment == "**", otherSegment == "*", otherSegment == "**":
+		return true
+	case isGlobSegment(segment) && isGlobSegment(otherSegment):
+		// can't tell
+		return true
+	case isGlobSegment(segment):
+		matched, _ := filepath.Match(segment, otherSegment)
+		return matched
+	case isGlobSegment(otherSegment):
+		matched, _ := filepath.Match(otherSegment, segment)
+		return matched
+	default:
+		return segment == otherSegment
+	}
+}
+
+// same as metricPatternsOverlap, for tag patterns
+func tagPatternsOverlap(pattern, otherPattern string) bool {
+	name, value, hasValue := splitTag(pattern)
+	otherName, otherValue, otherHasValue := splitTag(otherPattern)
+
+	if !segmentsOverlap(name, otherName) {
+		return false
+	}
+	if !hasValue || !otherHasValue || isRegexPattern(value) || isRegexPattern(otherValue) {
+		return true
+	}
+	return segmentsOverlap(value, otherValue)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	t.Run("it reports no problem with a valid config", func(t *testing.T) {
+		var buffer bytes.Buffer
+		if problems := check(&buffer, "test_fixtures/configs/check/valid.yml"); problems != 0 {
+			t.Errorf("Unexpected problems: %v", buffer.String())
+		}
+	})
+
+	t.Run("it reports all the problems it finds", func(t *testing.T) {
+		var buffer bytes.Buffer
+		problems := check(&buffer, "test_fixtures/configs/check/problems.yml")
+
+		expected := []string{
+			"test_fixtures/configs/check/problems.yml:2: unknown key listen_prot",
+			"test_fixtures/configs/check/problems.yml: only one of api_key, api_key_file and api_key_command can be set",
+			"test_fixtures/configs/check/problems.yml: unknown log level: VERBOSE",
+			"test_fixtures/pruning_configs/check/problems.yml:14: unknown key host_tag",
+			"Unable to load pruning config from test_fixtures/pruning_configs/invalid_regex.yml: " +
+				"test_fixtures/pruning_configs/invalid_regex.yml:7: invalid regular expression /^my_app\\.(db/: " +
+				"error parsing regexp: missing closing ): `^my_app\\.(db`",
+			"test_fixtures/configs/check/problems.yml: no pruning config found at test_fixtures/pruning_configs/check/missing/*.yml",
+			"Duplicate rule for my_app.debug.** at test_fixtures/pruning_configs/check/problems.yml:6, " +
+				"already defined at test_fixtures/pruning_configs/check/problems.yml:5",
+			"test_fixtures/pruning_configs/check/problems.yml:8: keep rule for other_app.requests never overrides any remove rule",
+			"test_fixtures/pruning_configs/check/problems.yml:18: keep rule for tags [instance] on [other_app.**] never overrides any remove rule",
+			"test_fixtures/pruning_configs/check/problems.yml:23: rule expired on 2020-01-01",
+			"10 problem(s) found in test_fixtures/configs/check/problems.yml",
+		}
+
+		if problems != len(expected)-1 {
+			t.Errorf("Unexpected number of problems: %v", problems)
+		}
+		if actual := strings.Split(strings.TrimSpace(buffer.String()), "\n"); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Unexpected output:\n%v", buffer.String())
+		}
+	})
+
+	t.Run("it fetches remote pruning configs", func(t *testing.T) {
+		server := newTestPruningConfigServer("metrics:\n  remove:\n    - my_app.debug\nhost_tag: true\n")
+		defer server.Close()
+		downServer := newTestPruningConfigServer("")
+		downServer.Close()
+
+		dir, err := ioutil.TempDir("/tmp", "k9-test-check-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "k9.yml")
+		configContent := fmt.Sprintf("pruning_configs:\n  - %v/k9.yml\n  - %v/k9.yml\n", server.URL, downServer.URL)
+		if err := ioutil.WriteFile(path, []byte(configContent), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var buffer bytes.Buffer
+		problems := check(&buffer, path)
+
+		expected := []string{
+			server.URL + "/k9.yml:4: unknown key host_tag",
+			"Unable to fetch pruning config from " + downServer.URL + "/k9.yml: Get \"" + downServer.URL +
+				"/k9.yml\": dial tcp " + downServer.Listener.Addr().String() + ": connect: connection refused",
+			"2 problem(s) found in " + path,
+		}
+
+		if problems != len(expected)-1 {
+			t.Errorf("Unexpected number of problems: %v", problems)
+		}
+		if actual := strings.Split(strings.TrimSpace(buffer.String()), "\n"); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Unexpected output:\n%v", buffer.String())
+		}
+	})
+
+	t.Run("it reports missing interpolated values", func(t *testing.T) {
+		os.Unsetenv("K9_TEST_DD_URL")
+
+		var buffer bytes.Buffer
+		check(&buffer, "test_fixtures/configs/interpolation.yml")
+
+		expected := "test_fixtures/configs/interpolation.yml:4: undefined environment variable K9_TEST_DD_URL\n" +
+			"1 problem(s) found in test_fixtures/configs/interpolation.yml\n"
+		if buffer.String() != expected {
+			t.Errorf("Unexpected output:\n%v", buffer.String())
+		}
+	})
+
+	t.Run("it checks the types of values once interpolated", func(t *testing.T) {
+		dir, err := ioutil.TempDir("/tmp", "k9-test-check-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "k9.yml")
+		if err := ioutil.WriteFile(path, []byte("listen_port: ${K9_TEST_PORT}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		os.Setenv("K9_TEST_PORT", "8284")
+		defer os.Unsetenv("K9_TEST_PORT")
+		var buffer bytes.Buffer
+		if problems := check(&buffer, path); problems != 0 {
+			t.Errorf("Unexpected output:\n%v", buffer.String())
+		}
+
+		os.Setenv("K9_TEST_PORT", "not_a_port")
+		buffer.Reset()
+		if problems := check(&buffer, path); problems != 1 || !strings.Contains(buffer.String(), "cannot unmarshal !!str `not_a_port` into int") {
+			t.Errorf("Unexpected output:\n%v", buffer.String())
+		}
+	})
+
+	t.Run("it parses configs the same way as the service", func(t *testing.T) {
+		dir, err := ioutil.TempDir("/tmp", "k9-test-check-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "k9.yml")
+		rawContent := []byte("listen_port: 8284\nlisten_port: 8285\n")
+		if err := ioutil.WriteFile(path, rawContent, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var buffer bytes.Buffer
+		if problems := check(&buffer, path); problems != 1 || !strings.Contains(buffer.String(), "k9.yml:2: duplicate key listen_port, the last one wins") {
+			t.Errorf("Unexpected output:\n%v", buffer.String())
+		}
+		document, err := parseAndInterpolate(rawContent, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content, err := parseConfigFileContent(document); err != nil || content.Listen_port != 8285 {
+			t.Errorf("Expected the service to use the last value: %v %v", content, err)
+		}
+	})
+
+	t.Run("it reports files it can't read", func(t *testing.T) {
+		var buffer bytes.Buffer
+		if problems := check(&buffer, "/i/dont/exist"); problems != 1 {
+			t.Errorf("Unexpected output: %v", buffer.String())
+		}
+	})
+}
+
+func TestMetricPatternsOverlap(t *testing.T) {
+	for _, testCase := range []struct {
+		pattern      string
+		otherPattern string
+		expected     bool
+	}{
+		{"my_app.requests", "my_app.requests", true},
+		{"my_app.requests", "my_app.errors", false},
+		{"my_app.**", "my_app.http.requests", true},
+		{"my_app.**", "my_app", false},
+		{"my_app.**.max", "my_app.profile.median", false},
+		{"my_app.**.max", "**.http.*", true},
+		{"my_app.*.max", "my_app.http.requests.max", false},
+		{"my_app.*_count", "my_app.http_count", true},
+		{"my_app.*_count", "my_app.http_max", false},
+		{"my_app.*_count", "my_app.http_*", true},
+		{"/^other_app/", "my_app.requests", true},
+	} {
+		if actual := metricPatternsOverlap(testCase.pattern, testCase.otherPattern); actual != testCase.expected {
+			t.Errorf("Unexpected overlap for %v and %v: %v", testCase.pattern, testCase.otherPattern, actual)
+		}
+		if actual := metricPatternsOverlap(testCase.otherPattern, testCase.pattern); actual != testCase.expected {
+			t.Errorf("Unexpected overlap for %v and %v: %v", testCase.otherPattern, testCase.pattern, actual)
+		}
+	}
+}
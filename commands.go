@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// k9 subcommands, e.g. `k9 -c /etc/k9/k9.conf explain my_app.requests env:prod`;
+// returns the exit code
+func runCommand(writer io.Writer, configPath, logLevel string, args []string) int {
+	switch args[0] {
+	case "explain":
+		if len(args) < 2 {
+			fmt.Fprintln(writer, "Usage: k9 [-c CONFIG] explain METRIC [TAG...]")
+			return 2
+		}
+		config := NewConfig(configPath, logLevel)
+
+		// so that `when` clauses on host tags get evaluated like in the service
+		var hostTags HostTagsRetriever
+		if settings := config.settings(); settings.ApiKey != "" && settings.ApplicationKey != "" {
+			retriever := NewHostsTags(settings.DdUrl, settings.ApiKey, settings.ApplicationKey, nil)
+			defer retriever.Stop()
+			config.SetHostTags(retriever)
+			hostTags = retriever
+		}
+
+		explain(writer, config.PruningConfig, hostTags, args[1], args[2:])
+		return 0
+	case "check":
+		if len(args) > 1 {
+			fmt.Fprintln(writer, "Usage: k9 [-c CONFIG] check")
+			return 2
+		}
+		if check(writer, configPath) != 0 {
+			return 1
+		}
+		return 0
+	default:
+		fmt.Fprintf(writer, "Unknown command: %v\n", args[0])
+		return 2
+	}
+}
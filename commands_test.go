@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	for _, testCase := range []struct {
+		args             []string
+		expectedExitCode int
+		expectedOutput   string
+	}{
+		{[]string{"explain", "my_app.requests"}, 0, "Metric: my_app.requests\n"},
+		{[]string{"explain"}, 2, "Usage: k9 [-c CONFIG] explain METRIC [TAG...]\n"},
+		{[]string{"check"}, 0, "No problems found in test_fixtures/configs/check/valid.yml\n"},
+		{[]string{"check", "whatever"}, 2, "Usage: k9 [-c CONFIG] check\n"},
+		{[]string{"unknown"}, 2, "Unknown command: unknown\n"},
+	} {
+		var buffer bytes.Buffer
+		exitCode := runCommand(&buffer, "test_fixtures/configs/check/valid.yml", "", testCase.args)
+		if exitCode != testCase.expectedExitCode {
+			t.Errorf("Unexpected exit code for %v: %v", testCase.args, exitCode)
+		}
+		if !strings.HasPrefix(buffer.String(), testCase.expectedOutput) {
+			t.Errorf("Unexpected output for %v: %q", testCase.args, buffer.String())
+		}
+	}
+
+	t.Run("check exits with 1 when it finds problems", func(t *testing.T) {
+		var buffer bytes.Buffer
+		if exitCode := runCommand(&buffer, "test_fixtures/configs/check/problems.yml", "", []string{"check"}); exitCode != 1 {
+			t.Errorf("Unexpected exit code: %v", exitCode)
+		}
+	})
+}
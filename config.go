@@ -1,9 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
+	"os"
+	"sync"
+	"time"
 
-	"gopkg.in/yaml.v2"
+	yamlv2 "gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
@@ -12,31 +17,57 @@ type Config struct {
 	DdUrl          string
 	ApiKey         string
 	ApplicationKey string
+	// see Gateway
+	GatewayMode          bool
+	GatewayFlushInterval time.Duration
+	GatewayGracePeriod   time.Duration
+	// see ConfigStatus
+	Status *ConfigStatus
+	// pruning configs fetched over HTTP(S)
+	RemotePruningConfigs *RemotePruningConfigs
 
-	path        string
-	logLevelSet bool
+	path string
+	// as found in the config file, see WatchedPaths
+	pruningConfigPaths []string
+	// a log level given on the command line overrides the config file's
+	logLevelOverridden bool
+	// the content of the last config file successfully loaded, nil if none
+	content *configFileContent
+	// used to evaluate `when` clauses on host tags, nil if none
+	hostTags HostTagsRetriever
+	// reloads and host tags changes can come from different goroutines
+	mutex sync.Mutex
 }
 
+const (
+	DEFAULT_LISTEN_PORT = 8283
+	DEFAULT_DD_URL      = "https://app.datadoghq.com"
+)
+
 func NewConfig(path, logLevel string) *Config {
 	config := &Config{
-		PruningConfig: NewPruningConfig(),
-		ListenPort:    8283,
-		DdUrl:         "https://app.datadoghq.com",
-		path:          path,
+		PruningConfig:        NewPruningConfig(),
+		ListenPort:           DEFAULT_LISTEN_PORT,
+		DdUrl:                DEFAULT_DD_URL,
+		Status:               &ConfigStatus{},
+		RemotePruningConfigs: NewRemotePruningConfigs(),
+		path:                 path,
+	}
+	if logLevel != "" {
+		_, err := setLogLevelFromString(logLevel)
+		config.logLevelOverridden = err == nil
 	}
-	config.maybeSetLogLevel(logLevel)
 	config.load(true)
 
 	return config
 }
 
 func (config *Config) maybeSetLogLevel(newLevel string) {
-	if newLevel == "" || config.logLevelSet {
+	if newLevel == "" || config.logLevelOverridden {
 		return
 	}
 
-	_, err := setLogLevelFromString(newLevel)
-	config.logLevelSet = err == nil
+	setLogLevelFromString(newLevel)
 }
 
 type configFileContent struct {
@@ -45,47 +76,267 @@ type configFileContent struct {
 	Listen_port     int
 	Api_key         string
 	Application_key string
-	Pruning_configs []string
+	// see configFileContent.secrets
+	Api_key_file            string
+	Api_key_command         string
+	Application_key_file    string
+	Application_key_command string
+	Pruning_configs         []string
+	Gauge_aggregation       string
+	Rule_precedence         string
+	Gateway_mode            bool
+	// in seconds
+	Gateway_flush_interval int
+	// in seconds
+	Gateway_grace_period int
+	// see RemotePruningConfigs
+	Remote_pruning_configs_cache_dir string
+	// in seconds
+	Remote_pruning_configs_poll_interval int
+}
+
+// `k9 check` parses configs the same way
+func parseConfigFileContent(document *yaml.Node) (*configFileContent, error) {
+	content := &configFileContent{}
+	if len(document.Content) == 0 {
+		// empty file
+		return content, nil
+	}
+
+	if err := decodeDocument(document, content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// config files get parsed with yaml.v3, to keep track of line numbers and to
+// interpolate values, but decoded with yaml.v2 like they always have been, so
+// that e.g. `yes` and `no` still are booleans, and duplicate keys still
+// override each other
+func decodeDocument(document *yaml.Node, out interface{}) error {
+	rawContent, err := yaml.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return yamlv2.Unmarshal(rawContent, out)
 }
 
 func (config *Config) Reload() {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+
 	logInfo("Reloading configuration...")
 	config.load(false)
 }
 
+// a copy of the settings that get applied on reload, see k9ReloaderShutdowner
+func (config *Config) settings() *Config {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+
+	return &Config{
+		ListenPort:           config.ListenPort,
+		DdUrl:                config.DdUrl,
+		ApiKey:               config.ApiKey,
+		ApplicationKey:       config.ApplicationKey,
+		GatewayMode:          config.GatewayMode,
+		GatewayFlushInterval: config.GatewayFlushInterval,
+		GatewayGracePeriod:   config.GatewayGracePeriod,
+	}
+}
+
+// reloads are all or nothing: if anything fails to load, we keep the previous
+// config
 func (config *Config) load(initialLoad bool) {
 	rawContent, err := ioutil.ReadFile(config.path)
 	if err != nil {
-		logFatal("Unable to read the config at %v: %v", config.path, err)
+		config.loadFailed(initialLoad, "Unable to read the config at %v: %v", config.path, err)
+		return
+	}
+
+	document, err := parseAndInterpolate(rawContent, config.path)
+	var content *configFileContent
+	if err == nil {
+		content, err = parseConfigFileContent(document)
+	}
+	if err != nil {
+		config.loadFailed(initialLoad, "Unable to parse the config at %v: %v", config.path, err)
+		return
 	}
 
-	content := configFileContent{}
-	err = yaml.Unmarshal(rawContent, &content)
+	apiKey, applicationKey, err := content.secrets()
 	if err != nil {
-		logFatal("Unable to parse the config at %v: %v", config.path, err)
+		config.loadFailed(initialLoad, "Unable to load the secrets for the config at %v: %v", config.path, err)
+		return
+	}
+	redactFromLogs(apiKey, applicationKey)
+	// nothing to roll back on the initial load
+	if initialLoad {
+		config.maybeSetLogLevel(content.Log_level)
 	}
 
+	if err := config.loadPruningConfig(content, initialLoad); err != nil {
+		config.Status.failed(err)
+		if !initialLoad {
+			logError("Reload failed, keeping the previous configuration: %v", err)
+			return
+		}
+	} else {
+		config.Status.succeeded()
+		if !initialLoad {
+			logInfo("Configuration reloaded")
+		}
+	}
+
+	// nothing gets applied until here
+	config.content = content
+	config.pruningConfigPaths = content.Pruning_configs
 	config.maybeSetLogLevel(content.Log_level)
-	config.loadPruningConfig(content.Pruning_configs, initialLoad)
+	config.RemotePruningConfigs.configure(time.Duration(content.Remote_pruning_configs_poll_interval)*time.Second,
+		content.Pruning_configs)
 
-	if initialLoad {
-		if content.Listen_port > 0 {
-			config.ListenPort = content.Listen_port
-		}
-		if content.Dd_Url != "" {
-			config.DdUrl = content.Dd_Url
+	// it's up to the caller to apply changes, see k9Reloader
+	config.ListenPort = DEFAULT_LISTEN_PORT
+	if content.Listen_port > 0 {
+		config.ListenPort = content.Listen_port
+	}
+	config.DdUrl = DEFAULT_DD_URL
+	if content.Dd_Url != "" {
+		config.DdUrl = content.Dd_Url
+	}
+	config.ApiKey = apiKey
+	config.ApplicationKey = applicationKey
+	config.GatewayMode = content.Gateway_mode
+	config.GatewayFlushInterval = time.Duration(content.Gateway_flush_interval) * time.Second
+	config.GatewayGracePeriod = time.Duration(content.Gateway_grace_period) * time.Second
+}
+
+// e.g. when the new port can't be listened on, see k9ReloaderShutdowner
+func (config *Config) setListenPort(port int) {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+
+	config.ListenPort = port
+}
+
+// the config file itself, and the pruning configs' paths or globs as of the
+// last config loaded, even if some of them failed to load; remote pruning configs get polled instead, see
+// RemotePruningConfigs
+func (config *Config) WatchedPaths() []string {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+
+	paths := []string{config.path}
+	for _, path := range config.pruningConfigPaths {
+		if !isRemotePruningConfig(path) {
+			paths = append(paths, path)
 		}
-		config.ApiKey = content.Api_key
-		config.ApplicationKey = content.Application_key
 	}
+	return paths
+}
+
+// `when` clauses on host tags can't match until we know the host's tags, so
+// the pruning configs get re-evaluated when the retriever changes, if needed
+func (config *Config) SetHostTags(hostTags HostTagsRetriever) {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+
+	config.hostTags = hostTags
+
+	if config.content == nil || !config.PruningConfig.dependsOnHostTags() {
+		return
+	}
+	logInfo("Host tags retriever changed, re-evaluating pruning configs")
+	if err := config.loadPruningConfig(config.content, false); err != nil {
+		logError("Unable to re-evaluate pruning configs, keeping the previous ones: %v", err)
+	}
+}
+
+// what `when` clauses in pruning configs get evaluated against
+func (config *Config) currentHost() *hostInfo {
+	hostname, err := os.Hostname()
+	if err != nil {
+		logWarn("Unable to retrieve host name, when clauses on host names won't match: %v", err)
+	}
+
+	host := &hostInfo{name: hostname}
+	if config.hostTags != nil {
+		host.tags = config.hostTags.GetTags()
+	}
+	return host
+}
+
+// fatal on the initial load, since we have nothing to fall back to
+func (config *Config) loadFailed(initialLoad bool, format string, v ...interface{}) {
+	if initialLoad {
+		logFatal(format, v...)
+	}
+
+	err := fmt.Errorf(format, v...)
+	logError("Reload failed, keeping the previous configuration: %v", err)
+	config.Status.failed(err)
 }
 
-func (config *Config) loadPruningConfig(pruningConfigsPaths []string, initialLoad bool) {
+// on the initial load, pruning configs that fail to load just get skipped;
+// on reloads, the previous pruning config is kept if any of them fails to load
+func (config *Config) loadPruningConfig(content *configFileContent, initialLoad bool) error {
 	newPruningConfig := NewPruningConfig()
+	newPruningConfig.host = config.currentHost()
+	newPruningConfig.schedulable = true
+
+	if content.Gauge_aggregation != "" {
+		if isValidAggregation(content.Gauge_aggregation) {
+			newPruningConfig.defaultGaugeAggregation = content.Gauge_aggregation
+		} else {
+			logWarn("Unknown gauge aggregation, ignoring: %v", content.Gauge_aggregation)
+		}
+	}
+
+	if content.Rule_precedence != "" {
+		if isValidRulePrecedence(content.Rule_precedence) {
+			newPruningConfig.rulePrecedence = content.Rule_precedence
+		} else {
+			logWarn("Unknown rule precedence, ignoring: %v", content.Rule_precedence)
+		}
+	}
 
-	for _, pruningConfigPath := range pruningConfigsPaths {
-		newPruningConfig.MergeWithFileOrGlob(pruningConfigPath)
+	var firstErr error
+	for _, pruningConfigPath := range content.Pruning_configs {
+		var err error
+		if isRemotePruningConfig(pruningConfigPath) {
+			err = config.mergeRemotePruningConfig(newPruningConfig, pruningConfigPath, content.remotePruningConfigsCacheDir())
+		} else {
+			err = newPruningConfig.MergeWithFileOrGlob(pruningConfigPath)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
 
-	config.PruningConfig.Reset(newPruningConfig)
+	if firstErr == nil || initialLoad {
+		config.PruningConfig.Reset(newPruningConfig)
+	}
+	return firstErr
+}
+
+func (config *Config) mergeRemotePruningConfig(pruningConfig *PruningConfig, url, cacheDir string) error {
+	rawContent, err := config.RemotePruningConfigs.fetch(url, cacheDir)
+	if err == nil {
+		err = pruningConfig.mergeWithContent(rawContent, url)
+	}
+	if err != nil {
+		err = fmt.Errorf("Unable to load pruning config from %v: %v", url, err)
+		logWarn("%v", err)
+		return err
+	}
+
+	config.RemotePruningConfigs.saveToCache(url, cacheDir, rawContent)
+	return nil
+}
+
+func (content *configFileContent) remotePruningConfigsCacheDir() string {
+	if content.Remote_pruning_configs_cache_dir != "" {
+		return content.Remote_pruning_configs_cache_dir
+	}
+	return DEFAULT_REMOTE_PRUNING_CONFIGS_CACHE_DIR
 }
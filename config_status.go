@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const STATUS_PATH = "/k9/status"
+
+// the outcome of the latest attempt to (re)load the config; it also serves it
+// as JSON on STATUS_PATH
+type ConfigStatus struct {
+	mutex              sync.RWMutex
+	lastLoad           time.Time
+	lastSuccessfulLoad time.Time
+	// nil if the last load succeeded
+	lastError error
+}
+
+func (status *ConfigStatus) succeeded() {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	status.lastLoad = time.Now()
+	status.lastSuccessfulLoad = status.lastLoad
+	status.lastError = nil
+}
+
+func (status *ConfigStatus) failed(err error) {
+	status.mutex.Lock()
+	defer status.mutex.Unlock()
+
+	status.lastLoad = time.Now()
+	status.lastError = err
+}
+
+type configStatusJson struct {
+	Status             string     `json:"status"`
+	Error              string     `json:"error,omitempty"`
+	LastLoad           *time.Time `json:"last_load,omitempty"`
+	LastSuccessfulLoad *time.Time `json:"last_successful_load,omitempty"`
+}
+
+func (status *ConfigStatus) toJson() *configStatusJson {
+	status.mutex.RLock()
+	defer status.mutex.RUnlock()
+
+	statusJson := &configStatusJson{Status: "ok"}
+	if status.lastError != nil {
+		statusJson.Status = "error"
+		statusJson.Error = status.lastError.Error()
+	}
+	if !status.lastLoad.IsZero() {
+		lastLoad := status.lastLoad
+		statusJson.LastLoad = &lastLoad
+	}
+	if !status.lastSuccessfulLoad.IsZero() {
+		lastSuccessfulLoad := status.lastSuccessfulLoad
+		statusJson.LastSuccessfulLoad = &lastSuccessfulLoad
+	}
+
+	return statusJson
+}
+
+func (status *ConfigStatus) Intercept(responseWriter http.ResponseWriter, request *http.Request) bool {
+	if request.Method != "GET" || request.URL.Path != STATUS_PATH {
+		return false
+	}
+
+	body, err := json.Marshal(status.toJson())
+	if maybeLogErrorAndReply(err, responseWriter, request, "Could not serialize the config status") {
+		return true
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Write(body)
+	return true
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConfigStatus(t *testing.T) {
+	status := &ConfigStatus{}
+
+	get := func(path string) (bool, *httptest.ResponseRecorder, map[string]interface{}) {
+		recorder := httptest.NewRecorder()
+		intercepted := status.Intercept(recorder, httptest.NewRequest("GET", path, nil))
+
+		var body map[string]interface{}
+		if intercepted {
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return intercepted, recorder, body
+	}
+
+	t.Run("it only intercepts requests for its own path", func(t *testing.T) {
+		if intercepted, _, _ := get("/api/v1/series/"); intercepted {
+			t.Errorf("Should not have intercepted")
+		}
+		if status.Intercept(httptest.NewRecorder(), httptest.NewRequest("POST", STATUS_PATH, nil)) {
+			t.Errorf("Should not have intercepted")
+		}
+	})
+
+	t.Run("it reports successful loads", func(t *testing.T) {
+		status.succeeded()
+
+		intercepted, recorder, body := get(STATUS_PATH)
+		if !intercepted || recorder.Code != http.StatusOK {
+			t.Fatalf("Unexpected response: %v", recorder.Code)
+		}
+		if body["status"] != "ok" || body["error"] != nil || body["last_load"] != body["last_successful_load"] {
+			t.Errorf("Unexpected body: %v", body)
+		}
+	})
+
+	t.Run("it reports failed loads, along with the last successful one", func(t *testing.T) {
+		_, _, previousBody := get(STATUS_PATH)
+		status.failed(errors.New("oops"))
+
+		_, _, body := get(STATUS_PATH)
+		if body["status"] != "error" || body["error"] != "oops" ||
+			body["last_successful_load"] != previousBody["last_successful_load"] {
+			t.Errorf("Unexpected body: %v", body)
+		}
+	})
+}
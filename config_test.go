@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -24,22 +25,26 @@ func TestNewConfig(t *testing.T) {
 		}
 
 		expectedConfig := &Config{
-			PruningConfig:  expectedPruningConfig,
-			ListenPort:     8284,
-			DdUrl:          "https://my_private.datadoghq.com",
-			ApiKey:         "9775a026f1ca7d1c6c5af9d94d9595a4",
-			ApplicationKey: "87ce4a24b5553d2e482ea8a8500e71b8ad4554ff",
+			PruningConfig:        expectedPruningConfig,
+			ListenPort:           8284,
+			DdUrl:                "https://my_private.datadoghq.com",
+			ApiKey:               "9775a026f1ca7d1c6c5af9d94d9595a4",
+			ApplicationKey:       "87ce4a24b5553d2e482ea8a8500e71b8ad4554ff",
+			Status:               config.Status,
+			RemotePruningConfigs: config.RemotePruningConfigs,
 
-			path:        "test_fixtures/configs/all.yml",
-			logLevelSet: true,
+			path:               "test_fixtures/configs/all.yml",
+			pruningConfigPaths: []string{"test_fixtures/pruning_configs/1.yml", "test_fixtures/pruning_configs/2.yml"},
+			logLevelOverridden: false,
+			content:            config.content,
 		}
 
 		if !reflect.DeepEqual(expectedConfig, config) {
 			t.Errorf("Unexpected config: %#v", config)
 		}
 
-		if logLevel != DEBUG {
-			t.Errorf("Unexpected log level: %v", logLevel)
+		if logLevel() != DEBUG {
+			t.Errorf("Unexpected log level: %v", logLevel())
 		}
 	})
 
@@ -53,12 +58,16 @@ func TestNewConfig(t *testing.T) {
 		}
 
 		expectedConfig := &Config{
-			PruningConfig: expectedPruningConfig,
-			ListenPort:    8283,
-			DdUrl:         "https://app.datadoghq.com",
+			PruningConfig:        expectedPruningConfig,
+			ListenPort:           8283,
+			DdUrl:                "https://app.datadoghq.com",
+			Status:               config.Status,
+			RemotePruningConfigs: config.RemotePruningConfigs,
 
-			path:        "test_fixtures/configs/just_pruning_confs_1.yml",
-			logLevelSet: false,
+			path:               "test_fixtures/configs/just_pruning_confs_1.yml",
+			pruningConfigPaths: []string{"test_fixtures/pruning_configs/1.yml", "test_fixtures/pruning_configs/2.yml", "/i/dont/exist"},
+			logLevelOverridden: false,
+			content:            config.content,
 		}
 
 		if !reflect.DeepEqual(expectedConfig, config) {
@@ -69,8 +78,8 @@ func TestNewConfig(t *testing.T) {
 	t.Run("a log level passed as argument overrides what's in the config file", func(t *testing.T) {
 		config = NewConfig("test_fixtures/configs/all.yml", "warn")
 
-		if logLevel != WARN {
-			t.Errorf("Unexpected log level: %v", logLevel)
+		if logLevel() != WARN {
+			t.Errorf("Unexpected log level: %v", logLevel())
 		}
 	})
 }
@@ -154,3 +163,168 @@ func TestReload(t *testing.T) {
 		t.Errorf("Config pointing to a different pruning config")
 	}
 }
+
+func TestGaugeAggregation(t *testing.T) {
+	t.Run("it reads the default gauge aggregation from the config file", func(t *testing.T) {
+		config := NewConfig("test_fixtures/configs/gauge_aggregation.yml", "")
+
+		if aggregation := config.PruningConfig.DefaultGaugeAggregation(); aggregation != AGGREGATION_LAST {
+			t.Errorf("Unexpected aggregation: %v", aggregation)
+		}
+	})
+
+	t.Run("it ignores unknown aggregations", func(t *testing.T) {
+		var config *Config
+		output := WithCatpuredLogging(func() {
+			config = NewConfig("test_fixtures/configs/invalid_gauge_aggregation.yml", "")
+		})
+
+		if !CheckLogLines(t, output, "WARN: Unknown gauge aggregation, ignoring: median") {
+			t.Errorf("Unexpected output: %v", output)
+		}
+		if aggregation := config.PruningConfig.DefaultGaugeAggregation(); aggregation != DEFAULT_GAUGE_AGGREGATION {
+			t.Errorf("Unexpected aggregation: %v", aggregation)
+		}
+	})
+}
+
+func TestRulePrecedenceConfig(t *testing.T) {
+	t.Run("it reads the rule precedence from the config file", func(t *testing.T) {
+		config := NewConfig("test_fixtures/configs/rule_precedence.yml", "")
+
+		if !config.PruningConfig.ConfigFor("my_app.debug.foo").Remove {
+			t.Errorf("Expected the most specific rule to win")
+		}
+	})
+
+	t.Run("it ignores unknown rule precedences", func(t *testing.T) {
+		var config *Config
+		output := WithCatpuredLogging(func() {
+			config = NewConfig("test_fixtures/configs/invalid_rule_precedence.yml", "")
+		})
+
+		if !CheckLogLines(t, output, "WARN: Unknown rule precedence, ignoring: whatever",
+			"WARN: Contradictory rules for tie.* at test_fixtures/pruning_configs/precedence/2.yml:7 and "+
+				"test_fixtures/pruning_configs/precedence/2.yml:10, the keep rule wins") {
+			t.Errorf("Unexpected output: %v", output)
+		}
+		if config.PruningConfig.ConfigFor("my_app.debug.foo").Remove {
+			t.Errorf("Expected keep rules to win")
+		}
+	})
+}
+
+func TestYAML11Semantics(t *testing.T) {
+	config := NewConfig("test_fixtures/configs/yaml_1_1.yml", "")
+
+	if !config.GatewayMode {
+		t.Errorf("Expected yes to be a boolean")
+	}
+	if config.ListenPort != 8284 {
+		t.Errorf("Expected the last listen port to win, got %v", config.ListenPort)
+	}
+}
+
+// tests that reloads are all or nothing
+func TestReloadKeepsPreviousConfigOnFailure(t *testing.T) {
+	tempFile, err := ioutil.TempFile("/tmp", "k9-test-reload-failure-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+
+	writeConfig := func(content string) {
+		if err := ioutil.WriteFile(tempPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig("pruning_configs:\n  - test_fixtures/pruning_configs/3.yml\n")
+	config := NewConfig(tempPath, "")
+	pruningConfig := config.PruningConfig
+
+	expectedPruningConfig := NewPruningConfig()
+	expectedPruningConfig.MergeWithFileOrGlob("test_fixtures/pruning_configs/3.yml")
+
+	initialStatus := config.Status.toJson()
+	if initialStatus.Status != "ok" || initialStatus.LastSuccessfulLoad == nil {
+		t.Fatalf("Unexpected status: %#v", initialStatus)
+	}
+	initialLogLevel := logLevel()
+
+	for _, testCase := range []struct {
+		name          string
+		content       string
+		expectedError string
+	}{
+		{
+			name: "when a pruning config is invalid",
+			content: "log_level: ERROR\npruning_configs:\n  - test_fixtures/pruning_configs/4.yml\n" +
+				"  - test_fixtures/pruning_configs/invalid_regex.yml\n  - http://localhost:1/k9.yml\n",
+			expectedError: "Unable to load pruning config from test_fixtures/pruning_configs/invalid_regex.yml: ",
+		},
+		{
+			name:          "when a pruning config is missing",
+			content:       "pruning_configs:\n  - test_fixtures/pruning_configs/4.yml\n  - /i/dont/exist\n",
+			expectedError: "Unable to load pruning config from /i/dont/exist: ",
+		},
+		{
+			name:          "when the config itself can't be parsed",
+			content:       "pruning_configs: [\n",
+			expectedError: "Unable to parse the config at " + tempPath + ": ",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			writeConfig(testCase.content)
+
+			output := WithCatpuredLogging(func() {
+				config.Reload()
+			})
+
+			if !strings.Contains(output, "ERROR: Reload failed, keeping the previous configuration: "+testCase.expectedError) {
+				t.Errorf("Unexpected output: %v", output)
+			}
+			if !reflect.DeepEqual(expectedPruningConfig, config.PruningConfig) {
+				t.Errorf("Unexpected pruning config: %#v", config.PruningConfig)
+			}
+
+			status := config.Status.toJson()
+			if status.Status != "error" || !strings.HasPrefix(status.Error, testCase.expectedError) {
+				t.Errorf("Unexpected status: %#v", status)
+			}
+			if *status.LastSuccessfulLoad != *initialStatus.LastSuccessfulLoad {
+				t.Errorf("Unexpected last successful load: %v", status.LastSuccessfulLoad)
+			}
+
+			// none of the other settings get applied either
+			if logLevel() != initialLogLevel {
+				t.Errorf("Unexpected log level: %v", logLevel())
+			}
+			if watchedPaths := config.WatchedPaths(); !reflect.DeepEqual(watchedPaths, []string{tempPath, "test_fixtures/pruning_configs/3.yml"}) {
+				t.Errorf("Unexpected watched paths: %v", watchedPaths)
+			}
+			if sources := config.RemotePruningConfigs.currentSources(); len(sources) != 0 {
+				t.Errorf("Unexpected remote pruning configs: %v", sources)
+			}
+		})
+	}
+
+	t.Run("it reloads again once the config has been fixed", func(t *testing.T) {
+		writeConfig("pruning_configs:\n  - test_fixtures/pruning_configs/4.yml\n")
+		config.Reload()
+
+		expectedPruningConfig = NewPruningConfig()
+		expectedPruningConfig.MergeWithFileOrGlob("test_fixtures/pruning_configs/4.yml")
+
+		if !reflect.DeepEqual(expectedPruningConfig, config.PruningConfig) {
+			t.Errorf("Unexpected pruning config: %#v", config.PruningConfig)
+		}
+		if config.PruningConfig != pruningConfig {
+			t.Errorf("Config pointing to a different pruning config")
+		}
+		if status := config.Status.toJson(); status.Status != "ok" || status.Error != "" {
+			t.Errorf("Unexpected status: %#v", status)
+		}
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type WatchableConfig interface {
+	// paths or globs of the files to watch
+	WatchedPaths() []string
+	Reload()
+}
+
+// reloads the config whenever any of its files change on disk, including when
+// new files matching a glob appear; it watches the directories containing
+// those files rather than the files themselves, so that files replaced by
+// renames or symlink swaps (e.g. Kubernetes ConfigMaps) get noticed too.
+// Falls back to polling if inotify isn't available.
+// Reloads only happen if the files' content has actually changed
+type ConfigWatcher struct {
+	config       WatchableConfig
+	debounce     time.Duration
+	pollInterval time.Duration
+
+	// nil when polling
+	watcher     *fsnotify.Watcher
+	watchedDirs map[string]bool
+
+	// guards the fields below, as well as checks
+	mutex       sync.Mutex
+	fingerprint string
+	timer       *time.Timer
+
+	done chan bool
+}
+
+const (
+	DEFAULT_WATCH_DEBOUNCE      = 1 * time.Second
+	DEFAULT_WATCH_POLL_INTERVAL = 5 * time.Second
+)
+
+// the optional intervals are the debounce and polling intervals, respectively
+// defaulting to DEFAULT_WATCH_DEBOUNCE and DEFAULT_WATCH_POLL_INTERVAL
+func NewConfigWatcher(config WatchableConfig, optionalIntervals ...time.Duration) *ConfigWatcher {
+	debounce := DEFAULT_WATCH_DEBOUNCE
+	pollInterval := DEFAULT_WATCH_POLL_INTERVAL
+
+	switch len(optionalIntervals) {
+	case 2:
+		pollInterval = optionalIntervals[1]
+		fallthrough
+	case 1:
+		debounce = optionalIntervals[0]
+	case 0:
+	default:
+		panic("Too many arguments for NewConfigWatcher")
+	}
+
+	return &ConfigWatcher{
+		config:       config,
+		debounce:     debounce,
+		pollInterval: pollInterval,
+		watchedDirs:  make(map[string]bool),
+	}
+}
+
+func (configWatcher *ConfigWatcher) Start() {
+	configWatcher.start(false)
+}
+
+func (configWatcher *ConfigWatcher) Stop() {
+	if configWatcher.done == nil {
+		logFatal("ConfigWatcher not started yet")
+	}
+
+	close(configWatcher.done)
+
+	configWatcher.mutex.Lock()
+	defer configWatcher.mutex.Unlock()
+	if configWatcher.timer != nil {
+		configWatcher.timer.Stop()
+	}
+}
+
+// Private helpers
+
+func (configWatcher *ConfigWatcher) start(forcePolling bool) {
+	configWatcher.done = make(chan bool)
+	configWatcher.fingerprint = fingerprintFiles(configWatcher.config.WatchedPaths())
+
+	if !forcePolling {
+		watcher, err := fsnotify.NewWatcher()
+		if err == nil {
+			configWatcher.watcher = watcher
+			configWatcher.updateWatchedDirs()
+			go configWatcher.watch()
+
+			logInfo("Watching config files for changes")
+			return
+		}
+		logWarn("Unable to watch config files, falling back to polling every %v: %v", configWatcher.pollInterval, err)
+	}
+
+	go configWatcher.poll(configWatcher.fingerprint)
+}
+
+func (configWatcher *ConfigWatcher) watch() {
+	defer configWatcher.watcher.Close()
+
+	for {
+		select {
+		case event := <-configWatcher.watcher.Events:
+			logDebug("Config watcher event: %v", event)
+			configWatcher.scheduleCheck()
+		case err := <-configWatcher.watcher.Errors:
+			logWarn("Error while watching config files: %v", err)
+		case <-configWatcher.done:
+			return
+		}
+	}
+}
+
+// changes seen while polling get debounced too, so that bursts spanning several
+// polls still only trigger one reload
+func (configWatcher *ConfigWatcher) poll(previousFingerprint string) {
+	ticker := time.NewTicker(configWatcher.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if fingerprint := fingerprintFiles(configWatcher.config.WatchedPaths()); fingerprint != previousFingerprint {
+				previousFingerprint = fingerprint
+				configWatcher.scheduleCheck()
+			}
+		case <-configWatcher.done:
+			return
+		}
+	}
+}
+
+// changes often come in bursts, e.g. when deploying several files
+func (configWatcher *ConfigWatcher) scheduleCheck() {
+	configWatcher.mutex.Lock()
+	defer configWatcher.mutex.Unlock()
+
+	if configWatcher.timer == nil {
+		configWatcher.timer = time.AfterFunc(configWatcher.debounce, configWatcher.check)
+	} else {
+		configWatcher.timer.Reset(configWatcher.debounce)
+	}
+}
+
+func (configWatcher *ConfigWatcher) check() {
+	configWatcher.mutex.Lock()
+	defer configWatcher.mutex.Unlock()
+
+	fingerprint := fingerprintFiles(configWatcher.config.WatchedPaths())
+	if fingerprint == configWatcher.fingerprint {
+		return
+	}
+
+	logInfo("Config files changed on disk, reloading")
+	configWatcher.config.Reload()
+
+	// the list of files to watch might have changed
+	configWatcher.fingerprint = fingerprintFiles(configWatcher.config.WatchedPaths())
+	if configWatcher.watcher != nil {
+		configWatcher.updateWatchedDirs()
+	}
+}
+
+// must be called with the mutex held, or before the watcher is started
+func (configWatcher *ConfigWatcher) updateWatchedDirs() {
+	dirs := watchedDirs(configWatcher.config.WatchedPaths())
+
+	for dir := range dirs {
+		if configWatcher.watchedDirs[dir] {
+			continue
+		}
+		if err := configWatcher.watcher.Add(dir); err != nil {
+			logWarn("Unable to watch %v for changes: %v", dir, err)
+			delete(dirs, dir)
+		}
+	}
+	for dir := range configWatcher.watchedDirs {
+		if !dirs[dir] {
+			configWatcher.watcher.Remove(dir)
+		}
+	}
+
+	configWatcher.watchedDirs = dirs
+}
+
+// the directories containing the given files, or matching the directory part
+// of the given globs
+func watchedDirs(paths []string) map[string]bool {
+	dirs := make(map[string]bool)
+
+	for _, path := range paths {
+		dir := filepath.Dir(path)
+		if !isGlobPattern(dir) {
+			dirs[dir] = true
+			continue
+		}
+
+		matches, _ := filepath.Glob(dir)
+		for _, match := range matches {
+			dirs[match] = true
+		}
+	}
+
+	return dirs
+}
+
+// hashes the content of all the files matching the given paths or globs, so
+// that we only reload when something actually changed
+func fingerprintFiles(paths []string) string {
+	filenames := make(map[string]bool)
+	for _, path := range paths {
+		if matches, err := filepath.Glob(path); err == nil && len(matches) != 0 {
+			for _, match := range matches {
+				filenames[match] = true
+			}
+		} else {
+			filenames[path] = true
+		}
+	}
+
+	var buffer strings.Builder
+	for _, filename := range sortedKeys(filenames) {
+		if content, err := ioutil.ReadFile(filename); err == nil {
+			fmt.Fprintf(&buffer, "%v:%x\n", filename, sha256.Sum256(content))
+		} else {
+			fmt.Fprintf(&buffer, "%v:-\n", filename)
+		}
+	}
+
+	return buffer.String()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testWatchableConfig struct {
+	mutex   sync.Mutex
+	paths   []string
+	reloads int
+}
+
+func (config *testWatchableConfig) WatchedPaths() []string {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	return config.paths
+}
+
+func (config *testWatchableConfig) Reload() {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	config.reloads++
+}
+
+func (config *testWatchableConfig) reloadCount() int {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	return config.reloads
+}
+
+func TestConfigWatcher(t *testing.T) {
+	for _, testCase := range []struct {
+		name    string
+		polling bool
+	}{
+		{"with inotify", false},
+		{"when polling", true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("/tmp", "k9-test-config-watcher-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			// atomically, so that polls never see half-written files
+			writeFile := func(name, content string) {
+				path := filepath.Join(dir, name)
+				if err := ioutil.WriteFile(path+".tmp", []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Rename(path+".tmp", path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Mkdir(filepath.Join(dir, "pruning_configs"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeFile("k9.conf", "pruning_configs: []")
+			writeFile("pruning_configs/1.yml", "metrics: {}")
+
+			config := &testWatchableConfig{
+				paths: []string{filepath.Join(dir, "k9.conf"), filepath.Join(dir, "pruning_configs/*.yml")},
+			}
+			watcher := NewConfigWatcher(config, 20*time.Millisecond, 20*time.Millisecond)
+			watcher.start(testCase.polling)
+			defer watcher.Stop()
+
+			assertReloadsEventually := func(t *testing.T, expected int) {
+				for i := 0; config.reloadCount() != expected; i++ {
+					if i == 100 {
+						t.Fatalf("Expected %v reloads, got %v", expected, config.reloadCount())
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				// and no more than that
+				time.Sleep(100 * time.Millisecond)
+				if reloads := config.reloadCount(); reloads != expected {
+					t.Fatalf("Expected %v reloads, got %v", expected, reloads)
+				}
+			}
+
+			t.Run("it reloads when the config file changes", func(t *testing.T) {
+				writeFile("k9.conf", "pruning_configs: [1.yml]")
+				assertReloadsEventually(t, 1)
+			})
+
+			t.Run("it reloads when a pruning config changes", func(t *testing.T) {
+				writeFile("pruning_configs/1.yml", "metrics: {remove: [foo]}")
+				assertReloadsEventually(t, 2)
+			})
+
+			t.Run("it reloads when a new file matches a glob", func(t *testing.T) {
+				writeFile("pruning_configs/2.yml", "metrics: {}")
+				assertReloadsEventually(t, 3)
+			})
+
+			t.Run("it debounces bursts of changes", func(t *testing.T) {
+				for i := 0; i < 5; i++ {
+					writeFile("pruning_configs/3.yml", "metrics: {remove: ["+string(rune('a'+i))+"]}")
+				}
+				assertReloadsEventually(t, 4)
+			})
+
+			t.Run("it ignores files that are not part of the config", func(t *testing.T) {
+				writeFile("pruning_configs/README", "not a pruning config")
+				writeFile("other.conf", "whatever")
+				assertReloadsEventually(t, 4)
+			})
+
+			t.Run("it ignores files whose content didn't change", func(t *testing.T) {
+				writeFile("k9.conf", "pruning_configs: [1.yml]")
+				assertReloadsEventually(t, 4)
+			})
+		})
+	}
+}
+
+func TestWatchedDirs(t *testing.T) {
+	dirs := watchedDirs([]string{"/etc/k9/k9.conf", "/etc/k9/pruning_configs/*.yml", "test_fixtures/pruning_*/1.yml"})
+
+	expected := map[string]bool{
+		"/etc/k9":                       true,
+		"/etc/k9/pruning_configs":       true,
+		"test_fixtures/pruning_configs": true,
+	}
+	if len(dirs) != len(expected) {
+		t.Errorf("Unexpected dirs: %v", dirs)
+	}
+	for dir := range expected {
+		if !dirs[dir] {
+			t.Errorf("Unexpected dirs: %v", dirs)
+		}
+	}
+}
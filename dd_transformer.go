@@ -7,7 +7,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"strings"
+	"sync"
 )
 
 type HostTagsRetriever interface {
@@ -17,6 +17,8 @@ type HostTagsRetriever interface {
 type DDTransformer struct {
 	config   *PruningConfig
 	hostTags HostTagsRetriever
+	// the host tags retriever gets replaced when credentials change
+	mutex sync.RWMutex
 }
 
 func NewTransformer(config *PruningConfig, hostTags HostTagsRetriever) *DDTransformer {
@@ -26,6 +28,21 @@ func NewTransformer(config *PruningConfig, hostTags HostTagsRetriever) *DDTransf
 	}
 }
 
+// it is okay for the retriever to be nil
+func (transformer *DDTransformer) SetHostTags(hostTags HostTagsRetriever) {
+	transformer.mutex.Lock()
+	defer transformer.mutex.Unlock()
+
+	transformer.hostTags = hostTags
+}
+
+func (transformer *DDTransformer) hostTagsRetriever() HostTagsRetriever {
+	transformer.mutex.RLock()
+	defer transformer.mutex.RUnlock()
+
+	return transformer.hostTags
+}
+
 func (transformer *DDTransformer) Transform(request *http.Request) error {
 	if err := logDebugTransformerRequest(request); err != nil {
 		return err
@@ -39,16 +56,7 @@ func (transformer *DDTransformer) Transform(request *http.Request) error {
 }
 
 func (transformer *DDTransformer) transformSeriesRequest(request *http.Request) error {
-	reader, encoded, err := maybeDecodeBody(request)
-	if err != nil {
-		return err
-	}
-
-	// parse the JSON
-	var jsonDocument map[string]interface{}
-	jsonDecoder := json.NewDecoder(reader)
-	defer reader.Close()
-	err = jsonDecoder.Decode(&jsonDocument)
+	jsonDocument, encoded, err := parseRequestJson(request)
 	if err != nil {
 		return err
 	}
@@ -70,6 +78,19 @@ func (transformer *DDTransformer) transformSeriesRequest(request *http.Request)
 	return nil
 }
 
+func parseRequestJson(request *http.Request) (jsonDocument map[string]interface{}, encoded bool, err error) {
+	reader, encoded, err := maybeDecodeBody(request)
+	if err != nil {
+		return
+	}
+
+	jsonDecoder := json.NewDecoder(reader)
+	defer reader.Close()
+	err = jsonDecoder.Decode(&jsonDocument)
+
+	return
+}
+
 func maybeDecodeBody(request *http.Request) (reader io.ReadCloser, encoded bool, err error) {
 	reader = request.Body
 
@@ -94,6 +115,8 @@ func (transformer *DDTransformer) transformSeriesRequestJson(jsonDocument map[st
 		return
 	}
 
+	hostTags := transformer.hostTagsRetriever()
+
 	newSeries := []map[string]interface{}{}
 	for _, rawMetric := range series {
 		metric, ok := rawMetric.(map[string]interface{})
@@ -109,13 +132,22 @@ func (transformer *DDTransformer) transformSeriesRequestJson(jsonDocument map[st
 		}
 
 		pruningConfig := transformer.config.ConfigFor(name)
-		if pruningConfig.Remove {
+		if pruningConfig.Remove || pruningConfig.RemovesSeries(metric) {
 			continue
 		}
 
-		// remove the host if needed
-		if pruningConfig.RemoveHost {
-			delete(metric, "host")
+		if pruningConfig.RenameTo != "" {
+			metric["metric"] = pruningConfig.RenameTo
+		}
+
+		// remove or replace the host if needed
+		removeHost := pruningConfig.RemovesHost(metric)
+		if removeHost {
+			if host, ok := pruningConfig.ReplaceHost(metric, hostTags); ok {
+				metric["host"] = host
+			} else {
+				delete(metric, "host")
+			}
 		}
 
 		// now to tags
@@ -132,9 +164,8 @@ func (transformer *DDTransformer) transformSeriesRequestJson(jsonDocument map[st
 						continue
 					}
 
-					splitTag := strings.SplitN(tag, ":", 2)
-					if !pruningConfig.RemoveTags[splitTag[0]] {
-						newTags = append(newTags, tag)
+					if !pruningConfig.RemovesTag(tag) {
+						newTags = append(newTags, pruningConfig.RenameTag(pruningConfig.RewriteTag(tag)))
 					}
 				}
 			} else {
@@ -143,14 +174,18 @@ func (transformer *DDTransformer) transformSeriesRequestJson(jsonDocument map[st
 		}
 
 		// host tags, if relevant
-		if pruningConfig.KeepHostTags && transformer.hostTags != nil {
-			for hostTagName, hostTagValues := range transformer.hostTags.GetTags() {
-				if !pruningConfig.RemoveTags[hostTagName] {
-					newTags = append(newTags, hostTagValues...)
+		if removeHost && pruningConfig.KeepHostTags && hostTags != nil {
+			for _, hostTagValues := range hostTags.GetTags() {
+				for _, hostTag := range hostTagValues {
+					if !pruningConfig.RemovesTag(hostTag) {
+						newTags = append(newTags, pruningConfig.RenameTag(pruningConfig.RewriteTag(hostTag)))
+					}
 				}
 			}
 		}
 
+		newTags = pruningConfig.AddStaticTags(newTags)
+
 		if len(newTags) == 0 {
 			if rawTags != nil {
 				delete(metric, "tags")
@@ -162,7 +197,7 @@ func (transformer *DDTransformer) transformSeriesRequestJson(jsonDocument map[st
 		newSeries = append(newSeries, metric)
 	}
 
-	jsonDocument["series"] = newSeries
+	jsonDocument["series"] = transformer.mergeCollidingSeries(newSeries)
 }
 
 func encodeBody(body []byte) []byte {
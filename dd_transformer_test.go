@@ -243,6 +243,26 @@ func TestDDTransformerProcessWithHostTags(t *testing.T) {
 	})
 }
 
+func TestDDTransformerProcessWithTagPatterns(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/tag_patterns.yml")
+	transformer := NewTransformer(config, &dummyHostTags{})
+
+	jsonDocument := parseJson(t, `{"series": [
+		{"metric": "my_app.my_metric", "host": "a", "tags": ["aws_region:us-east-1", "aws_account:1234", "kube_namespace:prod", "kube_pod:abcd", "env:prod"], "points": [[10, 1]]},
+		{"metric": "my_app.no_host", "host": "a", "tags": ["aws_region:us-east-1", "env:prod"], "points": [[10, 1]]}
+	]}`)
+	transformer.transformSeriesRequestJson(jsonDocument)
+
+	expectedOutput := normalizeSeries(parseJson(t, `{"series": [
+		{"metric": "my_app.my_metric", "host": "a", "tags": ["aws_account:1234", "kube_namespace:prod", "env:prod"], "points": [[10, 1]]},
+		{"metric": "my_app.no_host", "tags": ["env:prod", "instance-type:m4.large", "security-group:sg-abcd1234", "security-group:sg-1234abcd", "role:base", "role:mysql", "tag:aws"], "points": [[10, 1]]}
+	]}`))
+	if actualOutput := normalizeSeries(parseJson(t, jsonEncode(t, jsonDocument))); !reflect.DeepEqual(expectedOutput, actualOutput) {
+		t.Errorf("Unexpected body:\n%v\nVS expected:\n%v", jsonEncode(t, actualOutput), jsonEncode(t, expectedOutput))
+	}
+}
+
 // Private helpers
 
 func readBody(t *testing.T, request *http.Request) string {
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// explains what k9 does to a given metric, and why, e.g. for
+// `k9 explain my_app.requests env:prod host:my-host`
+// hostTags can be nil, in which case host tags are never added back, and `when`
+// clauses on host tags never match
+func explain(writer io.Writer, config *PruningConfig, hostTags HostTagsRetriever, metric string, tags []string) {
+	pruningConfig := config.ConfigFor(metric)
+
+	fmt.Fprintf(writer, "Metric: %v\n", metric)
+	if pruningConfig.RenameTo != "" {
+		fmt.Fprintf(writer, "Renamed to: %v\n", pruningConfig.RenameTo)
+	}
+	if hostTags == nil && config.dependsOnHostTags() {
+		fmt.Fprintln(writer, "\nNote: host tags were not retrieved (api_key and application_key are not set), "+
+			"so rules with when clauses on host tags were not applied")
+	}
+
+	fmt.Fprintln(writer, "\nMatching rules:")
+	sources := config.sourcesFor(metric)
+	if rule := config.renameRuleFor(metric); rule != nil && rule.source != nil {
+		sources = append([]*ruleSource{rule.source}, sources...)
+	}
+	if len(sources) == 0 {
+		fmt.Fprintln(writer, "  none")
+	}
+	for _, source := range sources {
+		fmt.Fprintf(writer, "  %-18v %-40v %v\n", source.section, source.pattern, source)
+	}
+
+	fmt.Fprintln(writer, "\nPruning config:")
+	fmt.Fprintf(writer, "  Remove: %v\n", pruningConfig.Remove)
+	if !pruningConfig.Remove {
+		fmt.Fprintf(writer, "  RemoveTags: %v\n", strings.Join(sortedKeys(pruningConfig.RemoveTags), ", "))
+		fmt.Fprintf(writer, "  RemoveHost: %v\n", pruningConfig.RemoveHost)
+		fmt.Fprintf(writer, "  KeepHostTags: %v\n", pruningConfig.KeepHostTags)
+		if pruningConfig.OnlyTags != nil {
+			fmt.Fprintf(writer, "  OnlyTags: %v\n", strings.Join(pruningConfig.OnlyTags, ", "))
+		}
+		if pruningConfig.RenameTags != nil {
+			fmt.Fprintf(writer, "  RenameTags: %v\n", formatRenameTags(pruningConfig.RenameTags))
+		}
+		if pruningConfig.AddTags != nil {
+			fmt.Fprintf(writer, "  AddTags: %v\n", strings.Join(pruningConfig.AddTags, ", "))
+		}
+		if pruningConfig.GaugeAggregation != "" {
+			fmt.Fprintf(writer, "  GaugeAggregation: %v\n", pruningConfig.GaugeAggregation)
+		}
+	}
+
+	if len(tags) != 0 {
+		fmt.Fprintln(writer, "\nTags:")
+		for _, tag := range tags {
+			fmt.Fprintf(writer, "  %-40v %v\n", tag, explainTag(pruningConfig, tag))
+		}
+	}
+
+	fmt.Fprintf(writer, "\nResult: %v\n", explainSeries(config, hostTags, metric, tags))
+}
+
+func explainTag(pruningConfig *MetricPruningConfig, tag string) string {
+	if pruningConfig.Remove {
+		return "removed along with the metric"
+	}
+	if name, _, _ := splitTag(tag); name == "host" {
+		if pruningConfig.RemovesTag(tag) {
+			return "host removed"
+		}
+		return "host kept"
+	}
+	if pruningConfig.RemovesTag(tag) {
+		return "removed"
+	}
+	if newTag := pruningConfig.RenameTag(pruningConfig.RewriteTag(tag)); newTag != tag {
+		return "kept as " + newTag
+	}
+	return "kept"
+}
+
+// runs a fake series through the transformer; a `host:` tag, if any, is used
+// as the series' host
+func explainSeries(config *PruningConfig, hostTags HostTagsRetriever, metric string, tags []string) string {
+	series := map[string]interface{}{
+		"metric": metric,
+		"points": []interface{}{[]interface{}{0.0, 0.0}},
+	}
+	rawTags := []interface{}{}
+	for _, tag := range tags {
+		if name, value, hasValue := splitTag(tag); name == "host" && hasValue {
+			series["host"] = value
+		} else {
+			rawTags = append(rawTags, tag)
+		}
+	}
+	series["tags"] = rawTags
+
+	jsonDocument := map[string]interface{}{"series": []interface{}{series}}
+	NewTransformer(config, hostTags).transformSeriesRequestJson(jsonDocument)
+
+	result, ok := jsonDocument["series"].([]map[string]interface{})
+	if !ok || len(result) == 0 {
+		return "removed"
+	}
+
+	var buffer strings.Builder
+	buffer.WriteString(fmt.Sprintf("%v", result[0]["metric"]))
+	if host, present := result[0]["host"]; present {
+		buffer.WriteString(fmt.Sprintf(" on host %v", host))
+	}
+	if resultTags, present := result[0]["tags"].([]string); present {
+		buffer.WriteString(fmt.Sprintf(" with tags %v", strings.Join(resultTags, ", ")))
+	}
+	return buffer.String()
+}
+
+func formatRenameTags(renameTags map[string]string) string {
+	renames := make([]string, 0, len(renameTags))
+	for from, to := range renameTags {
+		renames = append(renames, from+" -> "+to)
+	}
+	sort.Strings(renames)
+	return strings.Join(renames, ", ")
+}
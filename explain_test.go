@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/rename.yml")
+
+	explainToString := func(metric string, tags ...string) string {
+		var buffer bytes.Buffer
+		explain(&buffer, config, nil, metric, tags)
+		return buffer.String()
+	}
+
+	assertContains := func(t *testing.T, output string, expected ...string) {
+		for _, line := range expected {
+			if !strings.Contains(output, line) {
+				t.Errorf("Expected %q in output:\n%v", line, output)
+			}
+		}
+	}
+
+	t.Run("it lists the matching rules, their sources and the resulting series", func(t *testing.T) {
+		output := explainToString("old_lib.requests", "instance:i-1", "env:prod", "host:my-host")
+
+		assertContains(t, output,
+			"Renamed to: my_app.requests\n",
+			"rename             old_lib.**",
+			"rename.yml:6\n",
+			"tags.remove        my_app.**",
+			"rename.yml:17\n",
+			"RemoveTags: instance\n",
+			"instance:i-1                             removed\n",
+			"env:prod                                 kept\n",
+			"Result: my_app.requests on host my-host with tags env:prod\n",
+		)
+	})
+
+	t.Run("it reports removed metrics", func(t *testing.T) {
+		output := explainToString("my_app.debug.queries")
+
+		assertContains(t, output,
+			"metrics.remove     my_app.debug.**",
+			"Remove: true\n",
+			"Result: removed\n",
+		)
+	})
+
+	t.Run("it reports when no rule matches", func(t *testing.T) {
+		output := explainToString("other_app.requests", "env:prod")
+
+		assertContains(t, output,
+			"Matching rules:\n  none\n",
+			"Result: other_app.requests with tags env:prod\n",
+		)
+	})
+
+	t.Run("it says when rules on host tags couldn't be evaluated", func(t *testing.T) {
+		note := "Note: host tags were not retrieved"
+
+		for _, hostTags := range []HostTagsRetriever{nil, &dummyHostTags{}} {
+			config := NewPruningConfig()
+			config.host = &hostInfo{name: "db-1"}
+			if hostTags != nil {
+				config.host.tags = hostTags.GetTags()
+			}
+			config.MergeWithFileOrGlob("test_fixtures/pruning_configs/host_conditions/*.yml")
+
+			var buffer bytes.Buffer
+			explain(&buffer, config, hostTags, "my_app.requests", []string{"instance-type:m4.large"})
+			output := buffer.String()
+
+			if hostTags == nil {
+				assertContains(t, output, note, "instance-type:m4.large                   kept\n")
+			} else if strings.Contains(output, note) {
+				t.Errorf("Unexpected note in output:\n%v", output)
+			} else {
+				assertContains(t, output, "instance-type:m4.large                   removed\n")
+			}
+		}
+	})
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// in gateway mode, k9 doesn't forward series straight away, but instead
+// aggregates them across all the k9 sidecars that forward to it, and then
+// flushes one series per metric, type and tags combination once each flush
+// window has closed
+type Gateway struct {
+	proxy         *HttpProxy
+	transformer   *DDTransformer
+	apiKey        string
+	flushInterval time.Duration
+	// how long to wait for late points once a window has ended
+	gracePeriod time.Duration
+
+	// needed when updating the series
+	mutex sync.Mutex
+	// series sent with different API keys never get merged together
+	batches map[string]*gatewayBatch
+	// to flush batches in the order they were first received
+	apiKeys []string
+	// windows up to this one have been flushed already, so any late point for
+	// them gets dropped rather than overwrite the full aggregate in Datadog
+	flushedUntil float64
+
+	ticker *time.Ticker
+	done   chan bool
+}
+
+type gatewayBatch struct {
+	series map[string]*gatewaySeries
+	// to flush series in the order they were first received
+	keys []string
+}
+
+type gatewaySeries struct {
+	// the first metric received for that series, minus its points
+	metric     map[string]interface{}
+	aggregator *pointsAggregator
+}
+
+const (
+	DEFAULT_GATEWAY_FLUSH_INTERVAL = 10 * time.Second
+	DEFAULT_GATEWAY_GRACE_PERIOD   = 10 * time.Second
+)
+
+// the flush interval should match the agents' own flush interval, so that each
+// sidecar contributes at most one point per series and per flush window
+// series get forwarded with the API key the sidecars sent them with, or with
+// the given one if they didn't send any
+func NewGateway(proxy *HttpProxy, transformer *DDTransformer, apiKey string, flushInterval, gracePeriod time.Duration) *Gateway {
+	if flushInterval <= 0 {
+		flushInterval = DEFAULT_GATEWAY_FLUSH_INTERVAL
+	}
+	if gracePeriod <= 0 {
+		gracePeriod = DEFAULT_GATEWAY_GRACE_PERIOD
+	}
+
+	gateway := &Gateway{
+		proxy:         proxy,
+		transformer:   transformer,
+		apiKey:        apiKey,
+		flushInterval: flushInterval,
+		gracePeriod:   gracePeriod,
+	}
+	gateway.reset()
+	proxy.AddInterceptor(gateway)
+
+	return gateway
+}
+
+func (gateway *Gateway) Start() {
+	gateway.mutex.Lock()
+	ticker, done := time.NewTicker(gateway.flushInterval), make(chan bool)
+	gateway.ticker, gateway.done = ticker, done
+	flushInterval := gateway.flushInterval
+	gateway.mutex.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				gateway.Flush()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	logInfo("Gateway started, flushing every %v", flushInterval)
+}
+
+// flushes whatever series are still pending, including the windows that
+// haven't closed yet
+func (gateway *Gateway) Stop() {
+	gateway.mutex.Lock()
+	ticker, done := gateway.ticker, gateway.done
+	gateway.ticker, gateway.done = nil, nil
+	gateway.mutex.Unlock()
+
+	if ticker == nil {
+		logFatal("Gateway not started yet")
+	}
+
+	ticker.Stop()
+	close(done)
+	gateway.flush(time.Now(), true)
+}
+
+// applies a new API key, flush interval and grace period, e.g. on reloads;
+// pending series get flushed first if the flush interval changes
+func (gateway *Gateway) Reconfigure(apiKey string, flushInterval, gracePeriod time.Duration) {
+	if flushInterval <= 0 {
+		flushInterval = DEFAULT_GATEWAY_FLUSH_INTERVAL
+	}
+	if gracePeriod <= 0 {
+		gracePeriod = DEFAULT_GATEWAY_GRACE_PERIOD
+	}
+
+	gateway.mutex.Lock()
+	gateway.apiKey = apiKey
+	gateway.gracePeriod = gracePeriod
+	intervalChanged := flushInterval != gateway.flushInterval
+	started := gateway.ticker != nil
+	gateway.mutex.Unlock()
+
+	if !intervalChanged {
+		return
+	}
+
+	if started {
+		gateway.Stop()
+	}
+	gateway.mutex.Lock()
+	gateway.flushInterval = flushInterval
+	gateway.mutex.Unlock()
+	if started {
+		gateway.Start()
+	}
+}
+
+func (gateway *Gateway) Intercept(responseWriter http.ResponseWriter, request *http.Request) bool {
+	if request.Method != "POST" || request.URL.Path != "/api/v1/series/" {
+		return false
+	}
+
+	if err := logDebugTransformerRequest(request); maybeLogErrorAndReply(err, responseWriter, request, "Could not read body") {
+		return true
+	}
+
+	jsonDocument, _, err := parseRequestJson(request)
+	if maybeLogErrorAndReply(err, responseWriter, request, "Could not parse body") {
+		return true
+	}
+
+	apiKey := request.URL.Query().Get("api_key")
+	if apiKey == "" {
+		apiKey = request.Header.Get("DD-API-KEY")
+	}
+
+	gateway.transformer.transformSeriesRequestJson(jsonDocument)
+	gateway.add(jsonDocument["series"], apiKey)
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(http.StatusAccepted)
+	responseWriter.Write([]byte(`{"status": "ok"}`))
+
+	return true
+}
+
+// flushes the windows that ended at least a grace period ago; the others stay
+// buffered, since sidecars might still send points for them
+func (gateway *Gateway) Flush() {
+	gateway.flush(time.Now(), false)
+}
+
+// Private helpers
+
+// flushes all the windows if asked to, or only the closed ones as of now
+func (gateway *Gateway) flush(now time.Time, all bool) {
+	gateway.mutex.Lock()
+	limit := math.Inf(1)
+	if !all {
+		// the start of the latest closed window, at most
+		limit = float64(now.UnixNano())/float64(time.Second) - (gateway.flushInterval + gateway.gracePeriod).Seconds()
+		gateway.flushedUntil = math.Max(gateway.flushedUntil, limit)
+	}
+
+	metricsByApiKey := make(map[string][]map[string]interface{})
+	// the API keys to flush series for, and those still with pending series
+	apiKeys, pendingApiKeys := []string{}, []string{}
+	for _, apiKey := range gateway.apiKeys {
+		batch := gateway.batches[apiKey]
+
+		pendingKeys := []string{}
+		for _, key := range batch.keys {
+			series := batch.series[key]
+
+			points, latest := series.aggregator.takeUntil(limit)
+			if len(points) != 0 {
+				metricsByApiKey[apiKey] = append(metricsByApiKey[apiKey], series.toMetric(points))
+				gateway.flushedUntil = math.Max(gateway.flushedUntil, latest)
+			}
+
+			if series.aggregator.isEmpty() {
+				delete(batch.series, key)
+			} else {
+				pendingKeys = append(pendingKeys, key)
+			}
+		}
+		batch.keys = pendingKeys
+
+		if len(metricsByApiKey[apiKey]) != 0 {
+			apiKeys = append(apiKeys, apiKey)
+		}
+		if len(batch.keys) == 0 {
+			delete(gateway.batches, apiKey)
+		} else {
+			pendingApiKeys = append(pendingApiKeys, apiKey)
+		}
+	}
+	gateway.apiKeys = pendingApiKeys
+	gateway.mutex.Unlock()
+
+	for _, apiKey := range apiKeys {
+		metrics := metricsByApiKey[apiKey]
+		if err := gateway.send(metrics, apiKey); err != nil {
+			logError("Unable to flush %v series from the gateway: %v", len(metrics), err)
+		} else {
+			logDebug("Flushed %v series from the gateway", len(metrics))
+		}
+	}
+}
+
+// must be called with the mutex held, or before the gateway is started
+func (gateway *Gateway) reset() {
+	gateway.batches = make(map[string]*gatewayBatch)
+	gateway.apiKeys = []string{}
+}
+
+func (gateway *Gateway) add(rawSeries interface{}, apiKey string) {
+	series, ok := rawSeries.([]map[string]interface{})
+	if !ok {
+		// transformSeriesRequestJson has already logged about it
+		return
+	}
+
+	gateway.mutex.Lock()
+	defer gateway.mutex.Unlock()
+
+	if apiKey == "" {
+		apiKey = gateway.apiKey
+	}
+	batch := gateway.batches[apiKey]
+	if batch == nil {
+		batch = &gatewayBatch{series: make(map[string]*gatewaySeries)}
+		gateway.batches[apiKey] = batch
+		gateway.apiKeys = append(gateway.apiKeys, apiKey)
+	}
+
+	latePoints := 0
+	for _, metric := range series {
+		points, err := parsePoints(metric["points"])
+		if err != nil {
+			logWarn("Dropping metric from the gateway: %v", err)
+			continue
+		}
+
+		key := seriesKey(metric)
+		aggregatedSeries := batch.series[key]
+		if aggregatedSeries == nil {
+			aggregatedSeries = newGatewaySeries(metric, gateway.transformer.aggregationFor(metric))
+			batch.series[key] = aggregatedSeries
+			batch.keys = append(batch.keys, key)
+		}
+
+		for _, point := range points {
+			window := gateway.windowFor(point[0])
+			if window <= gateway.flushedUntil {
+				latePoints++
+				continue
+			}
+			aggregatedSeries.aggregator.add(window, point[1])
+		}
+	}
+
+	if latePoints != 0 {
+		logWarn("Dropping %v point(s) received by the gateway after their window was flushed", latePoints)
+	}
+}
+
+// points get grouped by flush window, so that points sent by different
+// sidecars at slightly different times still get aggregated together
+func (gateway *Gateway) windowFor(timestamp float64) float64 {
+	interval := gateway.flushInterval.Seconds()
+	return math.Floor(timestamp/interval) * interval
+}
+
+func (gateway *Gateway) send(metrics []map[string]interface{}, apiKey string) error {
+	body, err := json.Marshal(map[string]interface{}{"series": metrics})
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if apiKey != "" {
+		query.Set("api_key", apiKey)
+	}
+	request, err := http.NewRequest("POST", gateway.proxy.Target()+"/api/v1/series/?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := gateway.proxy.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode > 299 {
+		return errors.New("status code: " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
+
+func newGatewaySeries(metric map[string]interface{}, aggregation string) *gatewaySeries {
+	template := make(map[string]interface{}, len(metric))
+	for key, value := range metric {
+		if key != "points" {
+			template[key] = value
+		}
+	}
+
+	return &gatewaySeries{
+		metric:     template,
+		aggregator: newPointsAggregator(aggregation),
+	}
+}
+
+func (series *gatewaySeries) toMetric(points []interface{}) map[string]interface{} {
+	metric := make(map[string]interface{}, len(series.metric)+1)
+	for key, value := range series.metric {
+		metric[key] = value
+	}
+	metric["points"] = points
+
+	return metric
+}
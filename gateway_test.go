@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a fake Datadog API that records the series it receives
+type gatewayTestDatadog struct {
+	mutex    sync.Mutex
+	requests []*http.Request
+	bodies   []map[string]interface{}
+}
+
+func (datadog *gatewayTestDatadog) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	jsonDocument, _, err := parseRequestJson(request)
+	if err != nil {
+		panic(err)
+	}
+
+	datadog.mutex.Lock()
+	datadog.requests = append(datadog.requests, request)
+	datadog.bodies = append(datadog.bodies, jsonDocument)
+	datadog.mutex.Unlock()
+
+	responseWriter.WriteHeader(http.StatusAccepted)
+}
+
+func (datadog *gatewayTestDatadog) received() ([]*http.Request, []map[string]interface{}) {
+	datadog.mutex.Lock()
+	defer datadog.mutex.Unlock()
+
+	return append([]*http.Request{}, datadog.requests...), append([]map[string]interface{}{}, datadog.bodies...)
+}
+
+func TestGateway(t *testing.T) {
+	datadog := &gatewayTestDatadog{}
+	datadogServer := httptest.NewServer(datadog)
+	defer datadogServer.Close()
+
+	// the gateway itself
+	gatewayPruningConfig := NewPruningConfig()
+	gatewayPruningConfig.MergeWithFileOrGlob("test_fixtures/pruning_configs/gateway.yml")
+	gatewayTransformer := NewTransformer(gatewayPruningConfig, nil)
+	gatewayProxy := NewProxy(datadogServer.URL, gatewayTransformer)
+	gateway := NewGateway(gatewayProxy, gatewayTransformer, "", 10*time.Second, 5*time.Second)
+	gatewayServer := httptest.NewServer(gatewayProxy)
+	defer gatewayServer.Close()
+
+	// and 3 sidecars forwarding to it
+	sidecarPruningConfig := NewPruningConfig()
+	sidecarPruningConfig.MergeWithFileOrGlob("test_fixtures/pruning_configs/gateway_sidecar.yml")
+	sidecars := []*httptest.Server{}
+	for i := 0; i < 3; i++ {
+		sidecar := httptest.NewServer(NewProxy(gatewayServer.URL, NewTransformer(sidecarPruningConfig, nil)))
+		defer sidecar.Close()
+		sidecars = append(sidecars, sidecar)
+	}
+
+	postSeriesWithHeaders := func(t *testing.T, sidecar *httptest.Server, query string, headers map[string]string, host string, series ...string) {
+		body := fmt.Sprintf(`{"series": [%v]}`, strings.Replace(strings.Join(series, ","), "HOST", host, -1))
+		request, err := http.NewRequest("POST", sidecar.URL+"/api/v1/series/?"+query, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", "application/json")
+		for name, value := range headers {
+			request.Header.Set(name, value)
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusAccepted {
+			t.Errorf("Unexpected status code: %v", response.StatusCode)
+		}
+	}
+	postSeries := func(t *testing.T, sidecar *httptest.Server, host string, series ...string) {
+		postSeriesWithHeaders(t, sidecar, "api_key=my_api_key", nil, host, series...)
+	}
+
+	t.Run("it aggregates series from all sidecars by type and tags", func(t *testing.T) {
+		for i, sidecar := range sidecars {
+			host := fmt.Sprintf("host-%v", i)
+			postSeries(t, sidecar, host,
+				fmt.Sprintf(`{"metric": "my_app.requests", "type": "count", "host": "HOST", "tags": ["env:prod"], "points": [[10%v, %v]]}`, i, i+1),
+				fmt.Sprintf(`{"metric": "my_app.hits", "type": "rate", "host": "HOST", "tags": ["env:prod"], "points": [[10%v, 0.5]]}`, i),
+				fmt.Sprintf(`{"metric": "my_app.queue_size", "type": "gauge", "host": "HOST", "tags": ["env:prod"], "points": [[10%v, %v]]}`, i, 10*(i+1)),
+				fmt.Sprintf(`{"metric": "my_app.latency", "type": "gauge", "host": "HOST", "tags": ["env:prod"], "points": [[10%v, %v]]}`, i, 10*(i+1)),
+				fmt.Sprintf(`{"metric": "my_app.requests", "type": "count", "host": "HOST", "tags": ["env:staging"], "points": [[10%v, 1]]}`, i),
+				fmt.Sprintf(`{"metric": "other_app.requests", "type": "count", "host": "HOST", "points": [[10%v, 1]]}`, i))
+		}
+
+		// nothing should have reached Datadog yet
+		if _, bodies := datadog.received(); len(bodies) != 0 {
+			t.Fatalf("Unexpected requests: %#v", bodies)
+		}
+
+		gateway.flush(time.Unix(120, 0), false)
+
+		requests, bodies := datadog.received()
+		if len(requests) != 1 {
+			t.Fatalf("Unexpected requests: %#v", bodies)
+		}
+		if apiKey := requests[0].URL.Query().Get("api_key"); apiKey != "my_api_key" {
+			t.Errorf("Unexpected API key: %v", apiKey)
+		}
+
+		point := func(value float64) []interface{} {
+			return []interface{}{[]interface{}{100.0, value}}
+		}
+		envProd := []interface{}{"env:prod"}
+		expected := []interface{}{
+			map[string]interface{}{"metric": "my_app.requests", "type": "count", "tags": envProd, "points": point(6)},
+			map[string]interface{}{"metric": "my_app.hits", "type": "rate", "tags": envProd, "points": point(1.5)},
+			map[string]interface{}{"metric": "my_app.queue_size", "type": "gauge", "tags": envProd, "points": point(30)},
+			map[string]interface{}{"metric": "my_app.latency", "type": "gauge", "tags": envProd, "points": point(20)},
+			map[string]interface{}{"metric": "my_app.requests", "type": "count", "tags": []interface{}{"env:staging"}, "points": point(3)},
+		}
+		for i := 0; i < 3; i++ {
+			expected = append(expected, map[string]interface{}{
+				"metric": "other_app.requests",
+				"type":   "count",
+				"host":   fmt.Sprintf("host-%v", i),
+				"points": point(1),
+			})
+		}
+
+		if series := bodies[0]["series"]; !reflect.DeepEqual(expected, series) {
+			t.Errorf("Unexpected series:\n%#v\nVS expected:\n%#v", series, expected)
+		}
+	})
+
+	t.Run("it doesn't send anything when there's nothing to flush", func(t *testing.T) {
+		gateway.flush(time.Unix(130, 0), false)
+
+		if requests, bodies := datadog.received(); len(requests) != 1 {
+			t.Errorf("Unexpected requests: %#v", bodies)
+		}
+	})
+
+	t.Run("it still proxies other requests", func(t *testing.T) {
+		response, err := http.Post(sidecars[0].URL+"/intake/", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if requests, _ := datadog.received(); len(requests) != 2 || requests[1].URL.Path != "/intake/" {
+			t.Errorf("Unexpected requests: %#v", requests)
+		}
+	})
+
+	t.Run("it never merges series sent with different API keys", func(t *testing.T) {
+		gateway.Reconfigure("gateway_api_key", 10*time.Second, 5*time.Second)
+		defer gateway.Reconfigure("", 10*time.Second, 5*time.Second)
+
+		series := `{"metric": "my_app.requests", "type": "count", "host": "HOST", "tags": ["env:prod"], "points": [[200, 1]]}`
+		postSeries(t, sidecars[0], "host-0", series)
+		postSeriesWithHeaders(t, sidecars[1], "", map[string]string{"DD-API-KEY": "other_api_key"}, "host-1", series)
+		postSeriesWithHeaders(t, sidecars[2], "", nil, "host-2", series)
+		postSeries(t, sidecars[2], "host-2", series)
+
+		gateway.flush(time.Unix(220, 0), false)
+
+		requests, bodies := datadog.received()
+		if len(requests) != 5 {
+			t.Fatalf("Unexpected requests: %#v", bodies)
+		}
+		for i, expectedApiKey := range []string{"my_api_key", "other_api_key", "gateway_api_key"} {
+			if apiKey := requests[2+i].URL.Query().Get("api_key"); apiKey != expectedApiKey {
+				t.Errorf("Unexpected API key: %v", apiKey)
+			}
+		}
+
+		expectedPoints := []interface{}{[]interface{}{200.0, 2.0}}
+		if points := bodies[2]["series"].([]interface{})[0].(map[string]interface{})["points"]; !reflect.DeepEqual(expectedPoints, points) {
+			t.Errorf("Unexpected points: %#v", points)
+		}
+	})
+
+	t.Run("it waits for late points before flushing a window", func(t *testing.T) {
+		postSeries(t, sidecars[0], "host-0", `{"metric": "my_app.requests", "type": "count", "host": "HOST", "points": [[300, 1]]}`)
+
+		// the window has ended, but the grace period hasn't passed yet
+		gateway.flush(time.Unix(312, 0), false)
+		if requests, bodies := datadog.received(); len(requests) != 5 {
+			t.Fatalf("Unexpected requests: %#v", bodies)
+		}
+
+		postSeries(t, sidecars[1], "host-1", `{"metric": "my_app.requests", "type": "count", "host": "HOST", "points": [[305, 2]]}`)
+		gateway.flush(time.Unix(315, 0), false)
+
+		requests, bodies := datadog.received()
+		if len(requests) != 6 {
+			t.Fatalf("Unexpected requests: %#v", bodies)
+		}
+		expected := []interface{}{
+			map[string]interface{}{"metric": "my_app.requests", "type": "count", "points": []interface{}{[]interface{}{300.0, 3.0}}},
+		}
+		if series := bodies[5]["series"]; !reflect.DeepEqual(expected, series) {
+			t.Errorf("Unexpected series: %#v", series)
+		}
+
+		// too late, that window has been flushed already
+		output := WithLogLevelAndCapturedLogging(WARN, func() {
+			postSeries(t, sidecars[2], "host-2", `{"metric": "my_app.requests", "type": "count", "host": "HOST", "points": [[301, 4]]}`)
+		})
+		CheckLogLines(t, output, "WARN: Dropping 1 point(s) received by the gateway after their window was flushed")
+
+		gateway.flush(time.Unix(400, 0), false)
+		if requests, bodies := datadog.received(); len(requests) != 6 {
+			t.Errorf("Unexpected requests: %#v", bodies)
+		}
+	})
+
+	t.Run("it flushes pending series when stopped, even if their window is still open", func(t *testing.T) {
+		gateway.Start()
+		series := fmt.Sprintf(`{"metric": "my_app.requests", "type": "count", "host": "HOST", "points": [[%v, 1]]}`, time.Now().Unix())
+		postSeries(t, sidecars[0], "host-0", series)
+		gateway.Stop()
+
+		if requests, bodies := datadog.received(); len(requests) != 7 {
+			t.Errorf("Unexpected requests: %#v", bodies)
+		}
+	})
+}
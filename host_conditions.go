@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// the host k9 runs on, against which `when` clauses get evaluated when
+// loading pruning configs
+type hostInfo struct {
+	name string
+	// as returned by HostTagsRetriever, i.e. indexed by tag name; nil if
+	// unknown
+	tags map[string][]string
+}
+
+// host names can be glob patterns or regular expressions, and host tags tag
+// patterns, e.g. `role:web*`; a clause matches if, for each of its fields,
+// the host matches any of the patterns listed. See also rule_schedules.go
+func (whenConfig *pruningConfigFileContentWhenConfig) validate() error {
+	if len(whenConfig.Hosts) == 0 && len(whenConfig.Host_tags) == 0 &&
+		whenConfig.Not_before == "" && whenConfig.Expires == "" {
+		return errors.New("empty when clause")
+	}
+	if err := whenConfig.validateSchedule(); err != nil {
+		return err
+	}
+
+	for _, pattern := range whenConfig.Hosts {
+		var err error
+		if isRegexPattern(pattern) {
+			_, err = compileRegexPattern(pattern)
+		} else {
+			_, err = filepath.Match(pattern, "")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid host pattern %v in when clause: %v", pattern, err)
+		}
+	}
+	for _, pattern := range whenConfig.Host_tags {
+		if _, err := parseTagMatcher(pattern); err != nil {
+			return fmt.Errorf("invalid when clause: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// the clause must have been validated
+func (whenConfig *pruningConfigFileContentWhenConfig) matches(host *hostInfo) bool {
+	if len(whenConfig.Hosts) != 0 && !matchesHostname(whenConfig.Hosts, host.name) {
+		return false
+	}
+	if len(whenConfig.Host_tags) != 0 && !matchesHostTags(whenConfig.Host_tags, host.tags) {
+		return false
+	}
+	return true
+}
+
+func matchesHostname(patterns []string, hostname string) bool {
+	for _, pattern := range patterns {
+		if isRegexPattern(pattern) {
+			if regex, _ := compileRegexPattern(pattern); regex.MatchString(hostname) {
+				return true
+			}
+		} else if matched, _ := filepath.Match(pattern, hostname); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesHostTags(patterns []string, hostTags map[string][]string) bool {
+	for _, pattern := range patterns {
+		matcher, _ := parseTagMatcher(pattern)
+		for _, tags := range hostTags {
+			if matcher.matchesAny(tags) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// whether the rules at the given source with the given `when` clause, if any,
+// currently apply to this host; we also keep track of whether any rule depends
+// on the host's tags, see Config.SetHostTags
+func (config *PruningConfig) applies(whenConfig *pruningConfigFileContentWhenConfig, source string) bool {
+	if whenConfig == nil {
+		return true
+	}
+	if len(whenConfig.Host_tags) != 0 {
+		config.usesHostTags = true
+	}
+	if config.host != nil && !whenConfig.matches(config.host) {
+		return false
+	}
+	return config.scheduleAllows(whenConfig, source)
+}
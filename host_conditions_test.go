@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestHostConditions(t *testing.T) {
+	for _, testCase := range []struct {
+		name               string
+		host               *hostInfo
+		expectedRemove     bool
+		expectedRemoveTags map[string]bool
+		expectedAddTags    []string
+	}{
+		{
+			name:               "without a host, all rules apply",
+			host:               nil,
+			expectedRemove:     true,
+			expectedRemoveTags: map[string]bool{"instance-type": true, "availability-zone": true},
+			expectedAddTags:    []string{"tier:web"},
+		},
+		{
+			name:            "it matches host names",
+			host:            &hostInfo{name: "web-1"},
+			expectedRemove:  true,
+			expectedAddTags: []string{"tier:web"},
+		},
+		{
+			name:               "it matches host tags",
+			host:               &hostInfo{name: "db-1", tags: (&dummyHostTags{}).GetTags()},
+			expectedRemoveTags: map[string]bool{"instance-type": true},
+		},
+		{
+			name:               "all the fields of a when clause need to match",
+			host:               &hostInfo{name: "db-1", tags: map[string][]string{"role": []string{"role:web-db"}}},
+			expectedRemoveTags: map[string]bool{"availability-zone": true},
+		},
+		{
+			name: "nothing matches",
+			host: &hostInfo{name: "db-a", tags: map[string][]string{"role": []string{"role:web-db"}}},
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := NewPruningConfig()
+			config.host = testCase.host
+			if err := config.MergeWithFileOrGlob("test_fixtures/pruning_configs/host_conditions/*.yml"); err != nil {
+				t.Fatal(err)
+			}
+
+			if !config.usesHostTags {
+				t.Error("Expected the config to use host tags")
+			}
+
+			if remove := config.ConfigFor("my_app.debug").Remove; remove != testCase.expectedRemove {
+				t.Errorf("Unexpected remove: %v", remove)
+			}
+
+			pruningConfig := config.ConfigFor("my_app.requests")
+			expectedRemoveTags := testCase.expectedRemoveTags
+			if expectedRemoveTags == nil {
+				expectedRemoveTags = map[string]bool{}
+			}
+			if !reflect.DeepEqual(pruningConfig.RemoveTags, expectedRemoveTags) {
+				t.Errorf("Unexpected removed tags: %v", pruningConfig.RemoveTags)
+			}
+			if !reflect.DeepEqual(pruningConfig.AddTags, testCase.expectedAddTags) {
+				t.Errorf("Unexpected added tags: %v", pruningConfig.AddTags)
+			}
+		})
+	}
+
+	t.Run("it rejects invalid when clauses", func(t *testing.T) {
+		config := NewPruningConfig()
+
+		output := WithCatpuredLogging(func() {
+			config.MergeWithFileOrGlob("test_fixtures/pruning_configs/invalid_when.yml")
+		})
+
+		CheckLogLines(t, output, "WARN: Unable to load pruning config from test_fixtures/pruning_configs/invalid_when.yml: "+
+			"test_fixtures/pruning_configs/invalid_when.yml:7: invalid host pattern /^web-(/ in when clause: "+
+			"error parsing regexp: missing closing ): `^web-(`")
+	})
+}
+
+func TestConfigReevaluatesHostTagsConditions(t *testing.T) {
+	var config *Config
+	WithCatpuredLogging(func() {
+		config = NewConfig("test_fixtures/configs/host_conditions.yml", "")
+	})
+
+	if removeTags := config.PruningConfig.ConfigFor("my_app.requests").RemoveTags; len(removeTags) != 0 {
+		t.Errorf("Unexpected removed tags: %v", removeTags)
+	}
+
+	output := WithLogLevelAndCapturedLogging(INFO, func() {
+		config.SetHostTags(&dummyHostTags{})
+	})
+	CheckLogLines(t, output, "INFO: Host tags retriever changed, re-evaluating pruning configs")
+
+	expectedRemoveTags := map[string]bool{"instance-type": true}
+	if removeTags := config.PruningConfig.ConfigFor("my_app.requests").RemoveTags; !reflect.DeepEqual(removeTags, expectedRemoveTags) {
+		t.Errorf("Unexpected removed tags: %v", removeTags)
+	}
+
+	// the host tags can change while reloading and serving requests; meant to
+	// be run with -race, too
+	WithLogLevelAndCapturedLogging(ERROR, func() {
+		var wg sync.WaitGroup
+		for _, fun := range []func(){
+			func() { config.SetHostTags(&dummyHostTags{}) },
+			config.Reload,
+			func() { config.PruningConfig.ConfigFor("my_app.requests") },
+		} {
+			wg.Add(1)
+			go func(fun func()) {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					fun()
+				}
+			}(fun)
+		}
+		wg.Wait()
+	})
+	if removeTags := config.PruningConfig.ConfigFor("my_app.requests").RemoveTags; !reflect.DeepEqual(removeTags, expectedRemoveTags) {
+		t.Errorf("Unexpected removed tags: %v", removeTags)
+	}
+}
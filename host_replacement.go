@@ -0,0 +1,68 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+)
+
+// when the host gets removed from a metric, it can be replaced with a
+// coarser value instead, e.g. the cluster's name, so that metrics still get
+// grouped by cluster rather than becoming hostless; exactly one of value,
+// hostTag or regex is set
+type hostReplacement struct {
+	// a static value
+	value string
+	// the value of that tag, looked up in the series' tags, then in the host's
+	hostTag string
+	// or replace matches of that regex in the hostname
+	regex       *regexp.Regexp
+	replacement string
+}
+
+// returns false if no replacement could be computed, in which case the host
+// should just be removed
+func (replacement *hostReplacement) apply(metric map[string]interface{}, hostTags HostTagsRetriever) (string, bool) {
+	if replacement.value != "" {
+		return replacement.value, true
+	}
+
+	if replacement.hostTag != "" {
+		for _, tag := range seriesTags(metric) {
+			if name, value, hasValue := splitTag(tag); hasValue && name == replacement.hostTag {
+				return value, true
+			}
+		}
+
+		if hostTags != nil {
+			// if the host has several values for that tag, we pick the first one
+			// in lexicographic order, to be consistent across flushes
+			values := []string{}
+			for _, tag := range hostTags.GetTags()[replacement.hostTag] {
+				if _, value, hasValue := splitTag(tag); hasValue {
+					values = append(values, value)
+				}
+			}
+			if len(values) != 0 {
+				sort.Strings(values)
+				return values[0], true
+			}
+		}
+
+		return "", false
+	}
+
+	hostname, ok := metric["host"].(string)
+	if !ok || !replacement.regex.MatchString(hostname) {
+		return "", false
+	}
+	return replacement.regex.ReplaceAllString(hostname, replacement.replacement), true
+}
+
+// the value to replace the host with, if the host is to be removed; returns
+// false if the host should just be removed
+func (config *MetricPruningConfig) ReplaceHost(metric map[string]interface{}, hostTags HostTagsRetriever) (string, bool) {
+	if config.hostReplacement == nil {
+		return "", false
+	}
+	return config.hostReplacement.apply(metric, hostTags)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHostReplacements(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/replace_host.yml")
+
+	replaceHost := func(metricName string, metric map[string]interface{}, hostTags HostTagsRetriever) (string, bool) {
+		return config.ConfigFor(metricName).ReplaceHost(metric, hostTags)
+	}
+
+	t.Run("with a static value", func(t *testing.T) {
+		if host, ok := replaceHost("my_app.requests", map[string]interface{}{"host": "staging-004-e1a"}, nil); !ok || host != "my-cluster" {
+			t.Errorf("Unexpected replacement: %v %v", host, ok)
+		}
+	})
+
+	t.Run("with a tag, from the series first, then from the host's tags", func(t *testing.T) {
+		metric := map[string]interface{}{"host": "staging-004-e1a", "tags": []interface{}{"env:staging", "role:api"}}
+		if host, ok := replaceHost("my_app.by_role.requests", metric, &dummyHostTags{}); !ok || host != "api" {
+			t.Errorf("Unexpected replacement: %v %v", host, ok)
+		}
+
+		metric = map[string]interface{}{"host": "staging-004-e1a", "tags": []interface{}{"env:staging"}}
+		if host, ok := replaceHost("my_app.by_role.requests", metric, &dummyHostTags{}); !ok || host != "base" {
+			t.Errorf("Unexpected replacement: %v %v", host, ok)
+		}
+
+		if host, ok := replaceHost("my_app.by_role.requests", metric, nil); ok {
+			t.Errorf("Unexpected replacement: %v", host)
+		}
+	})
+
+	t.Run("with a pattern over the hostname", func(t *testing.T) {
+		if host, ok := replaceHost("my_app.by_env.requests", map[string]interface{}{"host": "staging-004-e1a"}, nil); !ok || host != "staging-e1a" {
+			t.Errorf("Unexpected replacement: %v %v", host, ok)
+		}
+
+		if host, ok := replaceHost("my_app.by_env.requests", map[string]interface{}{"host": "localhost"}, nil); ok {
+			t.Errorf("Unexpected replacement: %v", host)
+		}
+	})
+
+	t.Run("it doesn't replace anything for metrics without a rule", func(t *testing.T) {
+		if host, ok := replaceHost("other_app.requests", map[string]interface{}{"host": "staging-004-e1a"}, nil); ok {
+			t.Errorf("Unexpected replacement: %v", host)
+		}
+	})
+}
+
+func TestDDTransformerProcessWithHostReplacements(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/replace_host.yml")
+	transformer := NewTransformer(config, nil)
+
+	jsonDocument := parseJson(t, `{"series": [
+		{"metric": "my_app.by_env.requests", "type": "count", "host": "staging-004-e1a", "points": [[10, 1]]},
+		{"metric": "my_app.by_env.requests", "type": "count", "host": "staging-005-e1a", "points": [[10, 2]]},
+		{"metric": "my_app.by_env.requests", "type": "count", "host": "prod-001-e1a", "points": [[10, 4]]},
+		{"metric": "my_app.by_env.requests", "type": "count", "host": "localhost", "points": [[10, 8]]}
+	]}`)
+	transformer.transformSeriesRequestJson(jsonDocument)
+
+	// series from the same cluster get merged
+	expectedOutput := parseJson(t, `{"series": [
+		{"metric": "my_app.by_env.requests", "type": "count", "host": "staging-e1a", "points": [[10, 3]]},
+		{"metric": "my_app.by_env.requests", "type": "count", "host": "prod-e1a", "points": [[10, 4]]},
+		{"metric": "my_app.by_env.requests", "type": "count", "points": [[10, 8]]}
+	]}`)
+	if actualOutput := parseJson(t, jsonEncode(t, jsonDocument)); !reflect.DeepEqual(expectedOutput, actualOutput) {
+		t.Errorf("Unexpected body:\n%v\nVS expected:\n%v", jsonEncode(t, actualOutput), jsonEncode(t, expectedOutput))
+	}
+}
+
+func TestInvalidHostReplacement(t *testing.T) {
+	config := NewPruningConfig()
+
+	err := config.mergeWithFile("test_fixtures/pruning_configs/invalid_replace_host.yml")
+	if err == nil || err.Error() != "test_fixtures/pruning_configs/invalid_replace_host.yml:4: host replacement rule on [my_app.**] should have exactly one of value, host_tag or pattern" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// `${ENV_VAR}` gets replaced with the given environment variable's value,
+// `${file:/path}` with the content of the given file, minus any trailing
+// newline, and `$${...}` with a literal `${...}`
+var interpolationRegex = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// references to regular expression groups, e.g. `${1}` in replacements, are
+// left alone
+var groupReferenceRegex = regexp.MustCompile(`^[0-9]+$`)
+
+const INTERPOLATION_FILE_PREFIX = "file:"
+
+// parses a local config file and interpolates its values; the name is only
+// used in errors
+func parseAndInterpolate(rawContent []byte, name string) (*yaml.Node, error) {
+	document := &yaml.Node{}
+	if err := yaml.Unmarshal(rawContent, document); err != nil {
+		return nil, err
+	}
+	if err := interpolate(document, name); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// only scalar values get interpolated, after parsing, so that comments, keys
+// and the structure of the document are left alone whatever the values contain
+func interpolate(node *yaml.Node, name string) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := interpolate(child, name); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			if err := interpolate(node.Content[i], name); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		value, err := interpolateValue(node.Value)
+		if err != nil {
+			return fmt.Errorf("%v:%v: %v", name, node.Line, err)
+		}
+		if value != node.Value && node.Style == 0 {
+			// unquoted values get their type resolved again, e.g. for
+			// `listen_port: ${PORT}`
+			node.Tag = ""
+		}
+		node.Value = value
+	}
+	return nil
+}
+
+// stops at the first error
+func interpolateValue(value string) (string, error) {
+	var err error
+
+	interpolated := interpolationRegex.ReplaceAllStringFunc(value, func(match string) string {
+		if err != nil {
+			return ""
+		}
+		if match[1] == '$' {
+			// escaped
+			return match[1:]
+		}
+		reference := match[2 : len(match)-1]
+		if groupReferenceRegex.MatchString(reference) {
+			return match
+		}
+
+		var replacement string
+		replacement, err = interpolationValue(reference)
+		return replacement
+	})
+
+	return interpolated, err
+}
+
+func interpolationValue(reference string) (string, error) {
+	var value string
+
+	if strings.HasPrefix(reference, INTERPOLATION_FILE_PREFIX) {
+		path := strings.TrimPrefix(reference, INTERPOLATION_FILE_PREFIX)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("unable to read ${%v}: %v", reference, err)
+		}
+		value = strings.TrimRight(string(content), "\r\n")
+	} else {
+		if reference == "" {
+			return "", errors.New("empty interpolation ${}")
+		}
+		var present bool
+		if value, present = os.LookupEnv(reference); !present {
+			return "", fmt.Errorf("undefined environment variable %v", reference)
+		}
+	}
+
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("${%v} spans several lines", reference)
+	}
+	return value, nil
+}
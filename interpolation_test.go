@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	os.Setenv("K9_TEST_ENV", "production")
+	os.Setenv("K9_TEST_EMPTY", "")
+	os.Setenv("K9_TEST_PORT", "8080")
+	os.Setenv("K9_TEST_YAML", "*alias: not # a comment")
+	defer os.Unsetenv("K9_TEST_ENV")
+	defer os.Unsetenv("K9_TEST_EMPTY")
+	defer os.Unsetenv("K9_TEST_PORT")
+	defer os.Unsetenv("K9_TEST_YAML")
+	os.Unsetenv("K9_TEST_MISSING")
+
+	for _, testCase := range []struct {
+		name          string
+		content       string
+		expected      map[string]interface{}
+		expectedError string
+	}{
+		{
+			name:     "environment variables",
+			content:  "env: ${K9_TEST_ENV}\nrole: ${K9_TEST_EMPTY}web\n",
+			expected: map[string]interface{}{"env": "production", "role": "web"},
+		},
+		{
+			name:     "files",
+			content:  "api_key: ${file:test_fixtures/secrets/api_key}\n",
+			expected: map[string]interface{}{"api_key": "9775a026f1ca7d1c6c5af9d94d9595a4"},
+		},
+		{
+			name:     "escaped",
+			content:  "env: $${K9_TEST_ENV} ${K9_TEST_ENV}\n",
+			expected: map[string]interface{}{"env": "${K9_TEST_ENV} production"},
+		},
+		{
+			name:     "regular expression group references",
+			content:  "replacement: '/${1}_x/$${K9_TEST_ENV}'\n",
+			expected: map[string]interface{}{"replacement": "/${1}_x/${K9_TEST_ENV}"},
+		},
+		{
+			name:     "nothing to interpolate",
+			content:  "price: '$5 {not: interpolated}'\n",
+			expected: map[string]interface{}{"price": "$5 {not: interpolated}"},
+		},
+		{
+			name:     "types",
+			content:  "port: ${K9_TEST_PORT}\nquoted: '${K9_TEST_PORT}'\n",
+			expected: map[string]interface{}{"port": 8080, "quoted": "8080"},
+		},
+		{
+			name:     "values with YAML special characters",
+			content:  "tags:\n  - ${K9_TEST_YAML}\n",
+			expected: map[string]interface{}{"tags": []interface{}{"*alias: not # a comment"}},
+		},
+		{
+			name:     "comments and keys",
+			content:  "# ${K9_TEST_MISSING}\n${K9_TEST_MISSING}: ${K9_TEST_ENV} # ${K9_TEST_MISSING}\n",
+			expected: map[string]interface{}{"${K9_TEST_MISSING}": "production"},
+		},
+		{
+			name:          "missing environment variable",
+			content:       "env: ${K9_TEST_ENV}\nrole: ${K9_TEST_MISSING}\n",
+			expectedError: "k9.yml:2: undefined environment variable K9_TEST_MISSING",
+		},
+		{
+			name:          "missing file",
+			content:       "api_key: ${file:/i/dont/exist}\n",
+			expectedError: "k9.yml:1: unable to read ${file:/i/dont/exist}: open /i/dont/exist: no such file or directory",
+		},
+		{
+			name:          "multi-line file",
+			content:       "api_key: ${file:test_fixtures/secrets/multiline}\n",
+			expectedError: "k9.yml:1: ${file:test_fixtures/secrets/multiline} spans several lines",
+		},
+		{
+			name:          "empty reference",
+			content:       "api_key: ${}\n",
+			expectedError: "k9.yml:1: empty interpolation ${}",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			document, err := parseAndInterpolate([]byte(testCase.content), "k9.yml")
+
+			if testCase.expectedError != "" {
+				if err == nil || err.Error() != testCase.expectedError {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := make(map[string]interface{})
+			if err := document.Decode(&actual); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(testCase.expected, actual) {
+				t.Errorf("Unexpected result: %#v", actual)
+			}
+		})
+	}
+}
+
+func TestConfigInterpolation(t *testing.T) {
+	os.Setenv("K9_TEST_DD_URL", "https://my_private.datadoghq.com")
+	os.Setenv("K9_TEST_ENV", "production")
+	defer os.Unsetenv("K9_TEST_DD_URL")
+	defer os.Unsetenv("K9_TEST_ENV")
+
+	config := NewConfig("test_fixtures/configs/interpolation.yml", "")
+
+	if config.DdUrl != "https://my_private.datadoghq.com" || config.ApiKey != "9775a026f1ca7d1c6c5af9d94d9595a4" {
+		t.Errorf("Unexpected config: %#v", config)
+	}
+	expectedAddTags := []string{"env:production", "literal:${K9_TEST_ENV}"}
+	if addTags := config.PruningConfig.ConfigFor("my_app.requests").AddTags; !reflect.DeepEqual(addTags, expectedAddTags) {
+		t.Errorf("Unexpected added tags: %v", addTags)
+	}
+
+	t.Run("it fails on missing variables", func(t *testing.T) {
+		os.Unsetenv("K9_TEST_ENV")
+
+		output := WithLogLevelAndCapturedLogging(WARN, func() {
+			config.Reload()
+		})
+
+		CheckLogLines(t, output,
+			"WARN: Unable to load pruning config from test_fixtures/pruning_configs/interpolation.yml: "+
+				"test_fixtures/pruning_configs/interpolation.yml:6: undefined environment variable K9_TEST_ENV",
+			"ERROR: Reload failed, keeping the previous configuration: Unable to load pruning config from "+
+				"test_fixtures/pruning_configs/interpolation.yml: test_fixtures/pruning_configs/interpolation.yml:6: "+
+				"undefined environment variable K9_TEST_ENV")
+		if addTags := config.PruningConfig.ConfigFor("my_app.requests").AddTags; !reflect.DeepEqual(addTags, expectedAddTags) {
+			t.Errorf("Unexpected added tags: %v", addTags)
+		}
+	})
+}
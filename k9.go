@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 )
 
 var VERSION string
@@ -22,44 +23,37 @@ func main() {
 		return
 	}
 
-	// create the config
 	if *isDebug {
 		*logLevel = "DEBUG"
 	}
-	config := NewConfig(*configPath, *logLevel)
 
-	// build the host tags retriever
-	var hostTags *HostTags
-	if config.ApiKey != "" && config.ApplicationKey != "" {
-		hostTags = NewHostsTags(config.DdUrl, config.ApiKey, config.ApplicationKey, nil)
+	// subcommands don't start the proxy
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(os.Stdout, *configPath, *logLevel, flag.Args()))
 	}
 
+	// create the config
+	config := NewConfig(*configPath, *logLevel)
+
 	// build the transformer
-	transformer := NewTransformer(config.PruningConfig, hostTags)
+	transformer := NewTransformer(config.PruningConfig, nil)
 
 	// start the proxy
 	proxy := NewProxy(config.DdUrl, transformer)
+	proxy.AddInterceptor(config.Status)
+
+	// builds the host tags retriever, and the gateway if needed - in gateway
+	// mode, series get aggregated before being sent to Datadog
+	reloaderShutdowner := newK9ReloaderShutdowner(config, transformer, proxy)
+
 	proxy.Start(config.ListenPort)
 
-	// then listen for signals
-	reloaderShutdowner := &k9ReloaderShutdowner{
-		config: config,
-		proxy:  proxy,
-	}
+	// reload automatically when config files change on disk
+	NewConfigWatcher(reloaderShutdowner).Start()
+	// same for remote pruning configs
+	config.RemotePruningConfigs.Poll(reloaderShutdowner.Reload)
 
+	// then listen for signals
 	signalListener := &SignalListener{reloaderShutdowner: reloaderShutdowner}
 	signalListener.Run()
 }
-
-type k9ReloaderShutdowner struct {
-	config *Config
-	proxy  *HttpProxy
-}
-
-func (reloaderShutdowner *k9ReloaderShutdowner) Reload() {
-	reloaderShutdowner.config.Reload()
-}
-
-func (reloaderShutdowner *k9ReloaderShutdowner) Shutdown() {
-	reloaderShutdowner.proxy.Stop()
-}
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type LogLevel int
@@ -21,68 +24,77 @@ const (
 
 const DEFAULT_LOG_LEVEL = INFO
 
-var logLevel LogLevel = DEFAULT_LOG_LEVEL
+// accessed atomically, since goroutines keep logging while the level changes,
+// e.g. on reloads
+var currentLogLevel = int32(DEFAULT_LOG_LEVEL)
+
+func logLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&currentLogLevel))
+}
 
 func setLogLevel(newLevel LogLevel) (previousLevel LogLevel) {
-	previousLevel = logLevel
-	logLevel = newLevel
-	return
+	return LogLevel(atomic.SwapInt32(&currentLogLevel, int32(newLevel)))
 }
 
 func setLogLevelFromString(newLevelAsStr string) (LogLevel, error) {
-	var newLevel LogLevel = -1
-
-	switch strings.ToUpper(newLevelAsStr) {
-	case "DEBUG":
-		newLevel = DEBUG
-	case "INFO":
-		newLevel = INFO
-	case "WARN":
-		newLevel = WARN
-	case "ERROR":
-		newLevel = ERROR
-	case "FATAL":
-		newLevel = FATAL
-	}
+	newLevel := parseLogLevel(newLevelAsStr)
 
 	if newLevel == -1 {
 		var buffer bytes.Buffer
 		fmt.Fprintf(&buffer, "Unknown log level, ignoring: %v", newLevelAsStr)
 		message := buffer.String()
 		logWarn(message)
-		return logLevel, errors.New(message)
+		return logLevel(), errors.New(message)
 	} else {
 		return setLogLevel(newLevel), nil
 	}
 }
 
+// returns -1 for unknown levels
+func parseLogLevel(levelAsStr string) LogLevel {
+	switch strings.ToUpper(levelAsStr) {
+	case "DEBUG":
+		return DEBUG
+	case "INFO":
+		return INFO
+	case "WARN":
+		return WARN
+	case "ERROR":
+		return ERROR
+	case "FATAL":
+		return FATAL
+	default:
+		return -1
+	}
+}
+
 // comes in handy to log expensive operations in debug mode
 func logDebugWith(format string, callback func() []interface{}) {
-	if logLevel <= DEBUG {
+	if logLevel() <= DEBUG {
 		logDebug(format, callback()...)
 	}
 }
 
 func logDebug(format string, v ...interface{}) {
-	if logLevel <= DEBUG {
+	if logLevel() <= DEBUG {
 		doLog("DEBUG", format, v...)
 	}
 }
 
 func logInfo(format string, v ...interface{}) {
-	if logLevel <= INFO {
+	if logLevel() <= INFO {
 		doLog("INFO", format, v...)
 	}
 }
 
 func logWarn(format string, v ...interface{}) {
-	if logLevel <= WARN {
+	if logLevel() <= WARN {
 		doLog("WARN", format, v...)
 	}
 }
 
 func logError(format string, v ...interface{}) {
-	if logLevel <= ERROR {
+	if logLevel() <= ERROR {
 		doLog("ERROR", format, v...)
 	}
 }
@@ -93,5 +105,36 @@ func logFatal(format string, v ...interface{}) {
 }
 
 func doLog(level string, format string, v ...interface{}) {
-	log.Printf(level+": "+format, v...)
+	log.Print(redactSecrets(fmt.Sprintf(level+": "+format, v...)))
+}
+
+// secrets never get written to logs, even if they end up in error messages,
+// e.g. in URLs
+var (
+	secretsToRedact      = make(map[string]bool)
+	secretsToRedactMutex sync.RWMutex
+	secretQueryRegex     = regexp.MustCompile(`((?:api_key|application_key)=)[^&\s"']+`)
+)
+
+const REDACTED = "<redacted>"
+
+func redactFromLogs(secrets ...string) {
+	secretsToRedactMutex.Lock()
+	defer secretsToRedactMutex.Unlock()
+
+	for _, secret := range secrets {
+		if secret != "" {
+			secretsToRedact[secret] = true
+		}
+	}
+}
+
+func redactSecrets(message string) string {
+	secretsToRedactMutex.RLock()
+	for secret := range secretsToRedact {
+		message = strings.Replace(message, secret, REDACTED, -1)
+	}
+	secretsToRedactMutex.RUnlock()
+
+	return secretQueryRegex.ReplaceAllString(message, "${1}"+REDACTED)
 }
@@ -107,7 +107,7 @@ func TestLogDebugWith(t *testing.T) {
 }
 
 func TestSetLogLevelFromString(t *testing.T) {
-	previousLogLevel := logLevel
+	previousLogLevel := logLevel()
 
 	t.Run("it successfully parses and sets the level when fed a correct level",
 		func(t *testing.T) {
@@ -115,8 +115,8 @@ func TestSetLogLevelFromString(t *testing.T) {
 				setLogLevelFromString("DEBUG")
 			})
 
-			if logLevel != DEBUG {
-				t.Errorf("Unexpected log level: %v", logLevel)
+			if logLevel() != DEBUG {
+				t.Errorf("Unexpected log level: %v", logLevel())
 			}
 			if output != "" {
 				t.Errorf("Unexpected output: %v", output)
@@ -126,8 +126,8 @@ func TestSetLogLevelFromString(t *testing.T) {
 				setLogLevelFromString("ERROR")
 			})
 
-			if logLevel != ERROR {
-				t.Errorf("Unexpected log level: %v", logLevel)
+			if logLevel() != ERROR {
+				t.Errorf("Unexpected log level: %v", logLevel())
 			}
 			if output != "" {
 				t.Errorf("Unexpected output: %v", output)
@@ -140,8 +140,8 @@ func TestSetLogLevelFromString(t *testing.T) {
 				setLogLevelFromString("wARn")
 			})
 
-			if logLevel != WARN {
-				t.Errorf("Unexpected log level: %v", logLevel)
+			if logLevel() != WARN {
+				t.Errorf("Unexpected log level: %v", logLevel())
 			}
 			if output != "" {
 				t.Errorf("Unexpected output: %v", output)
@@ -165,3 +165,18 @@ func TestSetLogLevelFromString(t *testing.T) {
 
 	setLogLevel(previousLogLevel)
 }
+
+func TestRedactSecrets(t *testing.T) {
+	redactFromLogs("my_s3cr3t_key", "")
+
+	output := WithLogLevelAndCapturedLogging(DEBUG, func() {
+		logDebug("Using key %v", "my_s3cr3t_key")
+		logError("Unable to make a request to %v", "https://app.datadoghq.com/api/v1/tags/hosts/my-host?api_key=abc&application_key=def")
+	})
+
+	if !CheckLogLines(t, output,
+		"DEBUG: Using key <redacted>",
+		"ERROR: Unable to make a request to https://app.datadoghq.com/api/v1/tags/hosts/my-host?api_key=<redacted>&application_key=<redacted>") {
+		t.Errorf("Unexpected output: %v", output)
+	}
+}
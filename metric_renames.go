@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// renames metrics matching a pattern, e.g. `old_lib.**` to `my_app.**`: each
+// wildcard in the new name gets replaced with whatever the corresponding
+// wildcard in the pattern matched
+type renameRule struct {
+	from   []string
+	to     []string
+	source *ruleSource
+}
+
+func newRenameRule(from, to string) (*renameRule, error) {
+	rule := &renameRule{
+		from: strings.Split(from, "."),
+		to:   strings.Split(to, "."),
+	}
+
+	if isRegexPattern(from) {
+		return nil, fmt.Errorf("regular expressions are not supported in rename rules: %v", from)
+	}
+	for _, segment := range rule.from {
+		if isGlobSegment(segment) {
+			return nil, fmt.Errorf("partial wildcards are not supported in rename rules: %v", from)
+		}
+	}
+	for _, segment := range rule.to {
+		if isGlobSegment(segment) {
+			return nil, fmt.Errorf("partial wildcards are not supported in rename rules: %v", to)
+		}
+	}
+	if countWildcards(rule.from) != countWildcards(rule.to) {
+		return nil, fmt.Errorf("%v and %v should have the same number of wildcards", from, to)
+	}
+
+	return rule, nil
+}
+
+// returns the new name, or an empty string if the rule doesn't apply
+func (rule *renameRule) rename(metric string) string {
+	captures, matched := matchWithCaptures(rule.from, strings.Split(metric, "."), []string{})
+	if !matched {
+		return ""
+	}
+
+	newPath := make([]string, 0, len(rule.to))
+	for _, segment := range rule.to {
+		if segment == "*" || segment == "**" {
+			segment, captures = captures[0], captures[1:]
+		}
+		newPath = append(newPath, segment)
+	}
+
+	return strings.Join(newPath, ".")
+}
+
+func matchWithCaptures(pattern, path, captures []string) ([]string, bool) {
+	if len(pattern) == 0 {
+		return captures, len(path) == 0
+	}
+	if len(path) == 0 {
+		return nil, false
+	}
+
+	switch pattern[0] {
+	case "**":
+		// matches one or more segments
+		for i := 1; i <= len(path); i++ {
+			capture := strings.Join(path[:i], ".")
+			if result, matched := matchWithCaptures(pattern[1:], path[i:], append(captures, capture)); matched {
+				return result, true
+			}
+		}
+		return nil, false
+	case "*":
+		return matchWithCaptures(pattern[1:], path[1:], append(captures, path[0]))
+	default:
+		if pattern[0] != path[0] {
+			return nil, false
+		}
+		return matchWithCaptures(pattern[1:], path[1:], captures)
+	}
+}
+
+func countWildcards(path []string) int {
+	count := 0
+	for _, segment := range path {
+		if segment == "*" || segment == "**" {
+			count++
+		}
+	}
+	return count
+}
+
+// the first matching rule wins
+func (config *PruningConfig) rename(metric string) string {
+	if rule := config.renameRuleFor(metric); rule != nil {
+		return rule.rename(metric)
+	}
+	return metric
+}
+
+func (config *PruningConfig) renameRuleFor(metric string) *renameRule {
+	for _, rule := range config.renameRules {
+		if rule.rename(metric) != "" {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRenameRule(t *testing.T) {
+	for _, testCase := range []struct {
+		from     string
+		to       string
+		metric   string
+		expected string
+	}{
+		{"old_lib.**", "my_app.**", "old_lib.requests.count", "my_app.requests.count"},
+		{"old_lib.**", "my_app.**", "other_lib.requests.count", ""},
+		{"old_lib.**", "my_app.**", "old_lib", ""},
+		{"*.http.*.count", "http.*.*.count", "my_app.http.get.count", "http.my_app.get.count"},
+		{"*.http.*.count", "http.*.*.count", "my_app.http.get.max", ""},
+		{"old_lib.**.count", "my_app.**.total", "old_lib.http.requests.count", "my_app.http.requests.total"},
+		{"old_lib.requests", "my_app.requests", "old_lib.requests", "my_app.requests"},
+	} {
+		rule, err := newRenameRule(testCase.from, testCase.to)
+		if err != nil {
+			t.Fatalf("Unexpected error for %v -> %v: %v", testCase.from, testCase.to, err)
+		}
+
+		if actual := rule.rename(testCase.metric); actual != testCase.expected {
+			t.Errorf("Unexpected rename of %v with %v -> %v: %q", testCase.metric, testCase.from, testCase.to, actual)
+		}
+	}
+}
+
+func TestInvalidRenameRules(t *testing.T) {
+	for _, invalid := range [][2]string{
+		{"old_lib.*.**", "my_app.**"},
+		{"old_lib.**", "my_app.requests"},
+		{"/^old_lib/", "my_app.**"},
+		{"old_lib.req*", "my_app.*"},
+	} {
+		if _, err := newRenameRule(invalid[0], invalid[1]); err == nil {
+			t.Errorf("Expected an error for %v -> %v", invalid[0], invalid[1])
+		}
+	}
+
+	config := NewPruningConfig()
+	if err := config.mergeWithFile("test_fixtures/pruning_configs/invalid_rename.yml"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestRenames(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/rename.yml")
+
+	t.Run("renamed metrics are subject to the rules for their new name", func(t *testing.T) {
+		pruningConfig := config.ConfigFor("old_lib.requests")
+		expected := &MetricPruningConfig{
+			RemoveTags: map[string]bool{"instance": true},
+			RenameTo:   "my_app.requests",
+		}
+		if !reflect.DeepEqual(expected, pruningConfig) {
+			t.Errorf("Unexpected pruning config: %#v", pruningConfig)
+		}
+
+		if pruningConfig := config.ConfigFor("old_lib.debug.requests"); !reflect.DeepEqual(&MetricPruningConfig{Remove: true}, pruningConfig) {
+			t.Errorf("Unexpected pruning config: %#v", pruningConfig)
+		}
+	})
+
+	t.Run("the first matching rule wins", func(t *testing.T) {
+		if renameTo := config.ConfigFor("old_lib.legacy.requests").RenameTo; renameTo != "my_app.legacy.requests" {
+			t.Errorf("Unexpected rename: %v", renameTo)
+		}
+		if renameTo := config.ConfigFor("old_lib.http.get.count").RenameTo; renameTo != "my_app.http.get.count" {
+			t.Errorf("Unexpected rename: %v", renameTo)
+		}
+		if renameTo := config.ConfigFor("other_lib.http.get.count").RenameTo; renameTo != "http.other_lib.get.count" {
+			t.Errorf("Unexpected rename: %v", renameTo)
+		}
+	})
+
+	t.Run("it leaves other metrics alone", func(t *testing.T) {
+		if pruningConfig := config.ConfigFor("other_lib.requests"); pruningConfig.Remove || len(pruningConfig.RemoveTags) != 0 || pruningConfig.RenameTo != "" {
+			t.Errorf("Unexpected pruning config: %#v", pruningConfig)
+		}
+	})
+
+	t.Run("already renamed metrics don't get renamed again", func(t *testing.T) {
+		if renameTo := config.ConfigForRenamed("http.other_lib.get.count").RenameTo; renameTo != "" {
+			t.Errorf("Unexpected rename: %v", renameTo)
+		}
+	})
+}
+
+func TestDDTransformerProcessWithRenames(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/rename.yml")
+	transformer := NewTransformer(config, nil)
+
+	jsonDocument := parseJson(t, `{"series": [
+		{"metric": "old_lib.requests", "type": "count", "tags": ["instance:1", "env:prod"], "points": [[10, 1]]},
+		{"metric": "old_lib.requests", "type": "count", "tags": ["instance:2", "env:prod"], "points": [[10, 2]]},
+		{"metric": "my_app.requests", "type": "count", "tags": ["env:prod"], "points": [[10, 3]]},
+		{"metric": "old_lib.debug.requests", "type": "count", "points": [[10, 1]]},
+		{"metric": "other_lib.requests", "type": "count", "points": [[10, 1]]}
+	]}`)
+	transformer.transformSeriesRequestJson(jsonDocument)
+	series := parseJson(t, jsonEncode(t, jsonDocument))["series"]
+
+	// renamed series colliding with others get merged
+	expected := []interface{}{
+		map[string]interface{}{"metric": "my_app.requests", "type": "count", "tags": []interface{}{"env:prod"}, "points": []interface{}{[]interface{}{10.0, 6.0}}},
+		map[string]interface{}{"metric": "other_lib.requests", "type": "count", "points": []interface{}{[]interface{}{10.0, 1.0}}},
+	}
+	if !reflect.DeepEqual(expected, series) {
+		t.Errorf("Unexpected series: %#v", series)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,11 +17,21 @@ type RequestTransformer interface {
 	Transform(request *http.Request) error
 }
 
+// interceptors can choose to handle requests themselves instead of having them
+// proxied, in which case Intercept should return true; they get called in the
+// order they were added
+type RequestInterceptor interface {
+	Intercept(responseWriter http.ResponseWriter, request *http.Request) bool
+}
+
 type HttpProxy struct {
-	target      string
-	server      *http.Server
-	transformer RequestTransformer
-	client      *http.Client
+	target       string
+	server       *http.Server
+	transformer  RequestTransformer
+	interceptors []RequestInterceptor
+	client       *http.Client
+	// both the target and the interceptors can change while serving requests
+	mutex sync.RWMutex
 }
 
 // the target should include the protocol, e.g. http://localhost:8181
@@ -62,6 +74,41 @@ func NewProxy(target string, transformer RequestTransformer, optionalTimeouts ..
 	return proxy
 }
 
+func (proxy *HttpProxy) AddInterceptor(interceptor RequestInterceptor) {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+
+	proxy.interceptors = append(proxy.interceptors, interceptor)
+}
+
+func (proxy *HttpProxy) RemoveInterceptor(interceptor RequestInterceptor) {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+
+	interceptors := make([]RequestInterceptor, 0, len(proxy.interceptors))
+	for _, existingInterceptor := range proxy.interceptors {
+		if existingInterceptor != interceptor {
+			interceptors = append(interceptors, existingInterceptor)
+		}
+	}
+	proxy.interceptors = interceptors
+}
+
+func (proxy *HttpProxy) Target() string {
+	proxy.mutex.RLock()
+	defer proxy.mutex.RUnlock()
+
+	return proxy.target
+}
+
+// requests already in flight still go to the previous target
+func (proxy *HttpProxy) SetTarget(target string) {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+
+	proxy.target = target
+}
+
 func (proxy *HttpProxy) Start(localPort int) {
 	if proxy.server != nil {
 		logFatal("HttpProxy already started")
@@ -70,18 +117,49 @@ func (proxy *HttpProxy) Start(localPort int) {
 	addr := ":" + strconv.Itoa(localPort)
 	proxy.server = &http.Server{Addr: addr, Handler: proxy}
 
+	go serve(proxy.server, proxy.server.ListenAndServe)
+}
+
+// starts listening on the new port, then gracefully shuts down the previous
+// server, i.e. lets it finish serving the requests in flight; if we can't
+// listen on the new port, we keep listening on the previous one
+func (proxy *HttpProxy) Rebind(localPort int) error {
+	if proxy.server == nil {
+		logFatal("HttpProxy not started yet")
+	}
+
+	addr := ":" + strconv.Itoa(localPort)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	previousServer := proxy.server
+	server := &http.Server{Addr: addr, Handler: proxy}
+	proxy.server = server
+
+	go serve(server, func() error {
+		return server.Serve(listener)
+	})
 	go func() {
-		logInfo("HttpProxy listening on %v", addr)
+		previousServer.Shutdown(context.Background())
+		logInfo("HttpProxy stopped listening on %v", previousServer.Addr)
+	}()
 
-		if err := proxy.server.ListenAndServe(); err != nil {
-			if err.Error() == "http: Server closed" {
-				// normal shutdown
-				logInfo("HttpProxy closed")
-			} else {
-				logFatal("HttpProxy crashed: %#v %T %#v", err.Error(), err, err)
-			}
+	return nil
+}
+
+func serve(server *http.Server, listenAndServe func() error) {
+	logInfo("HttpProxy listening on %v", server.Addr)
+
+	if err := listenAndServe(); err != nil {
+		if err == http.ErrServerClosed {
+			// normal shutdown
+			logInfo("HttpProxy closed")
+		} else {
+			logFatal("HttpProxy crashed: %#v %T %#v", err.Error(), err, err)
 		}
-	}()
+	}
 }
 
 func (proxy *HttpProxy) Stop() {
@@ -95,7 +173,19 @@ func (proxy *HttpProxy) Stop() {
 }
 
 func (proxy *HttpProxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
-	logDebug("Received %v request for %v with headers %#v", request.Method, request.URL.Path, request.Header)
+	logDebugWith("Received %v request for %v with headers %#v", func() []interface{} {
+		return []interface{}{request.Method, request.URL.Path, redactedHeaders(request.Header)}
+	})
+
+	proxy.mutex.RLock()
+	interceptors, target := proxy.interceptors, proxy.target
+	proxy.mutex.RUnlock()
+
+	for _, interceptor := range interceptors {
+		if interceptor.Intercept(responseWriter, request) {
+			return
+		}
+	}
 
 	// transform the request
 	if proxy.transformer != nil {
@@ -110,7 +200,7 @@ func (proxy *HttpProxy) ServeHTTP(responseWriter http.ResponseWriter, request *h
 	if len(request.URL.RawQuery) > 0 || request.URL.ForceQuery {
 		pathWithQuery += "?" + request.URL.RawQuery
 	}
-	clientRequest, err := http.NewRequest(request.Method, proxy.target+pathWithQuery, request.Body)
+	clientRequest, err := http.NewRequest(request.Method, target+pathWithQuery, request.Body)
 	if maybeLogErrorAndReply(err, responseWriter, request, "Could not create client request") {
 		return
 	}
@@ -140,7 +230,7 @@ func (proxy *HttpProxy) ServeHTTP(responseWriter http.ResponseWriter, request *h
 				respBody = "<error reading response body: " + err.Error() + ">"
 			}
 
-			return []interface{}{request.Method, request.URL.Path, clientResponse.StatusCode, clientResponse.Header, respBody}
+			return []interface{}{request.Method, request.URL.Path, clientResponse.StatusCode, redactedHeaders(clientResponse.Header), respBody}
 		})
 
 	if clientResponse.StatusCode > 299 {
@@ -164,6 +254,18 @@ func (proxy *HttpProxy) ServeHTTP(responseWriter http.ResponseWriter, request *h
 	}
 }
 
+// e.g. `DD-API-KEY`, which might hold other keys than the ones k9 knows about
+func redactedHeaders(headers http.Header) http.Header {
+	redacted := make(http.Header, len(headers))
+	for key, values := range headers {
+		if strings.HasSuffix(strings.ToLower(key), "-key") {
+			values = []string{REDACTED}
+		}
+		redacted[key] = values
+	}
+	return redacted
+}
+
 func maybeLogErrorAndReply(err error, responseWriter http.ResponseWriter, request *http.Request, logPrefix string) bool {
 	if err == nil {
 		return false
@@ -395,3 +395,21 @@ func sleepIfCircle() {
 		time.Sleep(250 * time.Millisecond)
 	}
 }
+
+func TestRedactedHeaders(t *testing.T) {
+	headers := http.Header{
+		"Content-Type": []string{"application/json"},
+		"Dd-Api-Key":   []string{"9775a026f1ca7d1c6c5af9d94d9595a4"},
+	}
+
+	expected := http.Header{
+		"Content-Type": []string{"application/json"},
+		"Dd-Api-Key":   []string{"<redacted>"},
+	}
+	if actual := redactedHeaders(headers); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Unexpected headers: %v", actual)
+	}
+	if headers.Get("Dd-Api-Key") != "9775a026f1ca7d1c6c5af9d94d9595a4" {
+		t.Error("The original headers shouldn't change")
+	}
+}
@@ -1,69 +1,297 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
-
-	"gopkg.in/yaml.v2"
+	"time"
 )
 
 type PruningConfig struct {
-	root *configNode
+	// reloads Reset the config while requests are being served, so everything
+	// below is guarded by that mutex, except for the caches, which get filled
+	// while only holding the read lock
+	mutex sync.RWMutex
+	root  *configNode
 	// we cache the results for resolved metrics for efficiency
+	cacheMutex      sync.RWMutex
 	resolvedMetrics map[string]*MetricPruningConfig
+	// same, for metrics that have already been renamed, see ConfigForRenamed
+	resolvedRenamedMetrics map[string]*MetricPruningConfig
+	// used to merge colliding gauges when no specific rule applies
+	defaultGaugeAggregation string
+	// rules whose metric pattern is a regular expression can't be part of the
+	// trie, so we just check them all in turn
+	regexRules  []*regexRule
+	renameRules []*renameRule
+	// see rule_precedence.go; needs to be set before merging any file
+	rulePrecedence string
+	// only counted in file order mode
+	mergedFiles int
+	// duplicate or contradictory rules, see reportConflicts
+	conflicts []string
+	// what `when` clauses get evaluated against, see host_conditions.go;
+	// needs to be set before merging any file, nil to apply all rules
+	// regardless of their `when` clauses
+	host *hostInfo
+	// whether any `when` clause depends on the host's tags
+	usesHostTags bool
+	// the next time any rule is due to be activated or deactivated, see
+	// rule_schedules.go; zero if none
+	nextTransition time.Time
+	// whether to keep all the pruning configs merged, so that the config can
+	// be rebuilt on schedule; only set for the service's config, see
+	// Config.loadPruningConfig
+	schedulable bool
+	contents    []*pruningConfigFileContent
+	// only set while rebuilding the config, to the transition that triggered
+	// the rebuild
+	previousTransition time.Time
+}
+
+type regexRule struct {
+	pattern string
+	regex   *regexp.Regexp
+	value   *configValue
 }
 
 type configNode struct {
 	children map[string]*configNode
-	value    *configValue
+	// children whose key is a glob pattern, e.g. `*_count` - those need to be
+	// matched one by one
+	globChildren []*globConfigNode
+	value        *configValue
+}
+
+type globConfigNode struct {
+	pattern string
+	node    *configNode
 }
 
 type configValue struct {
-	remove         bool
-	keep           bool
-	removeTags     map[string]bool
-	keepTags       map[string]bool
+	remove bool
+	keep   bool
+	// in allowlist namespaces, only metrics allowed in that namespace pass; both
+	// indexed by namespace pattern
+	restrictNamespaces map[string]bool
+	allowNamespaces    map[string]bool
+	// the strongest rules for each decision, nil in merge mode
+	removeOrigin *ruleOrigin
+	keepOrigin   *ruleOrigin
+	// by namespace pattern
+	restrictOrigins map[string]*ruleOrigin
+	// by tag name, tag pattern or tag value pattern
+	removeTagOrigins       map[string]*ruleOrigin
+	keepTagOrigins         map[string]*ruleOrigin
+	onlyTagsOrigin         *ruleOrigin
+	removeConditionOrigins map[*seriesCondition]*ruleOrigin
+	removeTags             map[string]bool
+	keepTags               map[string]bool
+	// tag names containing wildcards, e.g. `aws_*`
+	removeTagPatterns map[string]bool
+	keepTagPatterns   map[string]bool
+	// rules on tag values, e.g. `status:ok`, indexed by their patterns
+	removeTagValues  map[string]*tagMatcher
+	keepTagValues    map[string]*tagMatcher
+	removeConditions []*seriesCondition
+	tagRewrites      []*tagRewrite
+	// if non-empty, only tags matching these names or patterns are permitted
+	onlyTags map[string]bool
+	// tag names to rename, and static tags to add
+	renameTags     map[string]string
+	addTags        map[string]bool
 	keepHostTags   bool
 	removeHostTags bool
+	// nil if the host should just be removed
+	hostReplacement *hostReplacement
+	// empty if no specific rule applies
+	gaugeAggregation string
+	// the most specific rule setting each of the fields below wins, whatever
+	// the order in which they get merged
+	gaugeAggregationOrigin *ruleOrigin
+	hostReplacementOrigin  *ruleOrigin
+	// by tag name
+	renameTagOrigins map[string]*ruleOrigin
+	addTagOrigins    map[string]*ruleOrigin
+	// all the rules that got merged into this value
+	sources []*ruleSource
 }
 
 type MetricPruningConfig struct {
-	Remove       bool
-	RemoveTags   map[string]bool
-	RemoveHost   bool
+	Remove     bool
+	RemoveTags map[string]bool
+	RemoveHost bool
+	// whether host tags get added back when the host gets removed
 	KeepHostTags bool
+	// how to merge colliding gauges, empty to use the default aggregation
+	GaugeAggregation string
+	// the metric's new name, empty if it shouldn't be renamed
+	RenameTo string
+	// if not nil, only tags matching these names or patterns are permitted
+	OnlyTags []string
+	// tag names to rename, nil if none
+	RenameTags map[string]string
+	// static tags to add, nil if none
+	AddTags []string
+
+	// nil if no tag pattern or tag value rule applies to this metric
+	tagRules         *tagRules
+	removeConditions []*seriesCondition
+	tagRewrites      []*tagRewrite
+	// nil if the host should just be removed
+	hostReplacement *hostReplacement
+	// whether the host's removal depends on its value, e.g. `host:/^tmp-/`
+	hostValueRules bool
 }
 
 func NewPruningConfig() (config *PruningConfig) {
 	return &PruningConfig{
-		root:            newConfigNode(),
-		resolvedMetrics: make(map[string]*MetricPruningConfig),
+		root:                    newConfigNode(),
+		resolvedMetrics:         make(map[string]*MetricPruningConfig),
+		resolvedRenamedMetrics:  make(map[string]*MetricPruningConfig),
+		defaultGaugeAggregation: DEFAULT_GAUGE_AGGREGATION,
+		rulePrecedence:          DEFAULT_RULE_PRECEDENCE,
 	}
 }
 
+// swaps in the rules of a config built separately, e.g. on reloads
 func (config *PruningConfig) Reset(other *PruningConfig) {
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+
+	config.reset(other)
+}
+
+// must be called with the write lock held
+func (config *PruningConfig) reset(other *PruningConfig) {
 	config.root = other.root
+	config.regexRules = other.regexRules
+	config.renameRules = other.renameRules
 	config.resolvedMetrics = make(map[string]*MetricPruningConfig)
+	config.resolvedRenamedMetrics = make(map[string]*MetricPruningConfig)
+	config.defaultGaugeAggregation = other.defaultGaugeAggregation
+	config.rulePrecedence = other.rulePrecedence
+	config.usesHostTags = other.usesHostTags
+	config.nextTransition = other.nextTransition
+	// only needed to rebuild the config on schedule, see maybeApplySchedule
+	config.host, config.schedulable, config.contents = nil, false, nil
+	if !other.nextTransition.IsZero() {
+		config.host = other.host
+		config.schedulable = other.schedulable
+		config.contents = other.contents
+	}
+}
+
+func (config *PruningConfig) DefaultGaugeAggregation() string {
+	config.mutex.RLock()
+	defer config.mutex.RUnlock()
+
+	return config.defaultGaugeAggregation
+}
+
+// whether any `when` clause depends on the host's tags
+func (config *PruningConfig) dependsOnHostTags() bool {
+	config.mutex.RLock()
+	defer config.mutex.RUnlock()
+
+	return config.usesHostTags
 }
 
 func (config *PruningConfig) ConfigFor(metric string) *MetricPruningConfig {
-	metricPruningConfig := config.resolvedMetrics[metric]
+	config.maybeApplySchedule()
+
+	config.mutex.RLock()
+	defer config.mutex.RUnlock()
+
+	return config.configFor(metric)
+}
+
+// must be called with the read lock held
+func (config *PruningConfig) configFor(metric string) *MetricPruningConfig {
+	metricPruningConfig := config.cached(config.resolvedMetrics, metric)
 
 	if metricPruningConfig == nil {
 		// not cached yet
-		configValue := newConfigValue()
-		resolveConfigFor(strings.Split(metric, "."), 0, config.root, configValue, false)
+		// renamed metrics are subject to the rules for their new name
+		newName := config.rename(metric)
+		metricPruningConfig = config.resolve(newName)
 
-		metricPruningConfig = configValue.toMetricPruningConfig()
+		if newName != metric && !metricPruningConfig.Remove {
+			metricPruningConfig.RenameTo = newName
+		}
+		config.cache(config.resolvedMetrics, metric, metricPruningConfig)
 	}
 
-	config.resolvedMetrics[metric] = metricPruningConfig
 	return metricPruningConfig
 }
 
+// same as ConfigFor, but for metrics that have already been renamed, and thus
+// shouldn't be renamed again
+func (config *PruningConfig) ConfigForRenamed(metric string) *MetricPruningConfig {
+	config.maybeApplySchedule()
+
+	config.mutex.RLock()
+	defer config.mutex.RUnlock()
+
+	if len(config.renameRules) == 0 {
+		return config.configFor(metric)
+	}
+
+	metricPruningConfig := config.cached(config.resolvedRenamedMetrics, metric)
+
+	if metricPruningConfig == nil {
+		// not cached yet
+		metricPruningConfig = config.resolve(metric)
+		config.cache(config.resolvedRenamedMetrics, metric, metricPruningConfig)
+	}
+
+	return metricPruningConfig
+}
+
+func (config *PruningConfig) cached(cache map[string]*MetricPruningConfig, metric string) *MetricPruningConfig {
+	config.cacheMutex.RLock()
+	defer config.cacheMutex.RUnlock()
+
+	return cache[metric]
+}
+
+func (config *PruningConfig) cache(cache map[string]*MetricPruningConfig, metric string, metricPruningConfig *MetricPruningConfig) {
+	config.cacheMutex.Lock()
+	defer config.cacheMutex.Unlock()
+
+	cache[metric] = metricPruningConfig
+}
+
+func (config *PruningConfig) resolve(metric string) *MetricPruningConfig {
+	configValue := config.resolveValue(metric)
+
+	if len(configValue.sources) != 0 {
+		logDebugWith("Resolving the pruning config for %v from rules at %v", func() []interface{} {
+			return []interface{}{metric, formatSources(configValue.sources)}
+		})
+	}
+
+	return configValue.toMetricPruningConfig()
+}
+
+func (config *PruningConfig) resolveValue(metric string) *configValue {
+	configValue := newConfigValue()
+	resolveConfigFor(strings.Split(metric, "."), 0, config.root, configValue, false)
+	for _, rule := range config.regexRules {
+		if rule.regex.MatchString(metric) {
+			configValue.merge(rule.value)
+		}
+	}
+
+	return configValue
+}
+
 func resolveConfigFor(path []string, currentIndex int, currentNode *configNode,
 	configValue *configValue, ongoingDoubleWildcard bool) {
 
@@ -85,6 +313,13 @@ func resolveConfigFor(path []string, currentIndex int, currentNode *configNode,
 	// then, single wildcard
 	resolveConfigFor(path, currentIndex+1, currentNode.children["*"], configValue, false)
 
+	// then partial wildcards
+	for _, globChild := range currentNode.globChildren {
+		if matched, _ := filepath.Match(globChild.pattern, path[currentIndex]); matched {
+			resolveConfigFor(path, currentIndex+1, globChild.node, configValue, false)
+		}
+	}
+
 	// then exact match
 	resolveConfigFor(path, currentIndex+1, currentNode.children[path[currentIndex]], configValue, false)
 }
@@ -93,21 +328,99 @@ type pruningConfigFileContentTagsConfig struct {
 	Metrics   []string
 	Tags      []string
 	Host_tags bool
+	// nil if the rule applies to all hosts
+	When *pruningConfigFileContentWhenConfig
+}
+
+type pruningConfigFileContentWhenConfig struct {
+	Hosts     []string
+	Host_tags []string
+	// see parseWhenTimestamp
+	Not_before string
+	Expires    string
+}
+
+type pruningConfigFileContentAggregationConfig struct {
+	Metrics []string
+	Gauges  string
+}
+
+type pruningConfigFileContentConditionalConfig struct {
+	Metrics     []string
+	Tags        []string
+	Type        []string
+	Device_name string
+}
+
+type pruningConfigFileContentRewriteConfig struct {
+	Metrics     []string
+	Tag         string
+	Pattern     string
+	Replacement string
+	Truncate    int
+}
+
+type pruningConfigFileContentAllowConfig struct {
+	Namespace string
+	Metrics   []string
+}
+
+type pruningConfigFileContentTagRenameConfig struct {
+	Metrics []string
+	From    string
+	To      string
+}
+
+type pruningConfigFileContentReplaceHostConfig struct {
+	Metrics     []string
+	Value       string
+	Host_tag    string
+	Pattern     string
+	Replacement string
+}
+
+type pruningConfigFileContentRenameConfig struct {
+	From string
+	To   string
 }
 
 type pruningConfigFileContent struct {
+	// only relevant with the priority rule precedence
+	Priority int
+
+	// nil if the whole file applies to all hosts
+	When *pruningConfigFileContentWhenConfig
+
 	Metrics struct {
-		Remove []string
-		Keep   []string
+		Remove    []string
+		Keep      []string
+		Remove_if []pruningConfigFileContentConditionalConfig
+		Allow     []pruningConfigFileContentAllowConfig
 	}
 
 	Tags struct {
 		Remove []pruningConfigFileContentTagsConfig
 		Keep   []pruningConfigFileContentTagsConfig
+		Only   []pruningConfigFileContentTagsConfig
+		Rename []pruningConfigFileContentTagRenameConfig
+		Add    []pruningConfigFileContentTagsConfig
 	}
+
+	Aggregations []pruningConfigFileContentAggregationConfig
+
+	Rewrite []pruningConfigFileContentRewriteConfig
+
+	Replace_host []pruningConfigFileContentReplaceHostConfig
+
+	Rename []pruningConfigFileContentRenameConfig
+
+	// see parsePruningConfig
+	filename string
+	lines    map[string][]int
 }
 
-func (config *PruningConfig) MergeWithFileOrGlob(filenameOrGlob string) {
+// files that fail to load get skipped, and the first such failure is returned
+func (config *PruningConfig) MergeWithFileOrGlob(filenameOrGlob string) error {
 	err := config.mergeWithFile(filenameOrGlob)
 
 	if pathError, ok := err.(*os.PathError); ok && pathError.Err == syscall.ENOENT {
@@ -115,18 +428,25 @@ func (config *PruningConfig) MergeWithFileOrGlob(filenameOrGlob string) {
 		matches, globErr := filepath.Glob(filenameOrGlob)
 
 		if globErr == nil && len(matches) > 0 {
-			err = nil
+			var firstErr error
 			for _, filename := range matches {
 				if newErr := config.mergeWithFile(filename); newErr != nil {
-					logWarn("Unable to load pruning config from %v: %v", filename, newErr)
+					newErr = fmt.Errorf("Unable to load pruning config from %v: %v", filename, newErr)
+					logWarn("%v", newErr)
+					if firstErr == nil {
+						firstErr = newErr
+					}
 				}
 			}
+			return firstErr
 		}
 	}
 
 	if err != nil {
-		logWarn("Unable to load pruning config from %v: %v", filenameOrGlob, err)
+		err = fmt.Errorf("Unable to load pruning config from %v: %v", filenameOrGlob, err)
+		logWarn("%v", err)
 	}
+	return err
 }
 
 func (config *PruningConfig) mergeWithFile(filename string) error {
@@ -135,60 +455,539 @@ func (config *PruningConfig) mergeWithFile(filename string) error {
 		return err
 	}
 
-	content := pruningConfigFileContent{}
-	err = yaml.Unmarshal(rawContent, &content)
+	// remote pruning configs don't get interpolated, since they shouldn't be
+	// able to read local files
+	document, err := parseAndInterpolate(rawContent, filename)
+	if err != nil {
+		return err
+	}
+	content, err := decodePruningConfig(document, filename)
+	if err != nil {
+		return err
+	}
+
+	return config.merge(content)
+}
+
+// the name is only used in error messages and logs
+func (config *PruningConfig) mergeWithContent(rawContent []byte, name string) error {
+	content, err := parsePruningConfig(rawContent, name)
 	if err != nil {
 		return err
 	}
 
-	config.merge(&content)
+	return config.merge(content)
+}
+
+func (content *pruningConfigFileContent) validate() error {
+	if content.When != nil {
+		if err := content.When.validate(); err != nil {
+			return fmt.Errorf("%v: %v", content.filename, err)
+		}
+	}
+
+	for i, pattern := range content.Metrics.Remove {
+		if err := validateMetricPattern(pattern); err != nil {
+			return content.errorAt("metrics.remove", i, err)
+		}
+	}
+	for i, pattern := range content.Metrics.Keep {
+		if err := validateMetricPattern(pattern); err != nil {
+			return content.errorAt("metrics.keep", i, err)
+		}
+	}
+	for i, conditionalConfig := range content.Metrics.Remove_if {
+		if err := conditionalConfig.validate(); err != nil {
+			return content.errorAt("metrics.remove_if", i, err)
+		}
+	}
+	for i, allowConfig := range content.Metrics.Allow {
+		if err := allowConfig.validate(); err != nil {
+			return content.errorAt("metrics.allow", i, err)
+		}
+	}
+
+	for section, tagsConfigs := range map[string][]pruningConfigFileContentTagsConfig{
+		"tags.remove": content.Tags.Remove,
+		"tags.keep":   content.Tags.Keep,
+	} {
+		for i, tagsConfig := range tagsConfigs {
+			if err := tagsConfig.validate(); err != nil {
+				return content.errorAt(section, i, err)
+			}
+		}
+	}
+	for i, onlyConfig := range content.Tags.Only {
+		if err := onlyConfig.validateOnly(); err != nil {
+			return content.errorAt("tags.only", i, err)
+		}
+	}
+	for i, renameConfig := range content.Tags.Rename {
+		if err := renameConfig.validate(); err != nil {
+			return content.errorAt("tags.rename", i, err)
+		}
+	}
+	for i, addConfig := range content.Tags.Add {
+		if err := addConfig.validateAdd(); err != nil {
+			return content.errorAt("tags.add", i, err)
+		}
+	}
+
+	for i, aggregationConfig := range content.Aggregations {
+		if err := aggregationConfig.validate(); err != nil {
+			return content.errorAt("aggregations", i, err)
+		}
+	}
+
+	for i, rewriteConfig := range content.Rewrite {
+		if _, err := rewriteConfig.toTagRewrite(); err != nil {
+			return content.errorAt("rewrite", i, err)
+		}
+		if err := validateMetricPatterns(rewriteConfig.Metrics); err != nil {
+			return content.errorAt("rewrite", i, err)
+		}
+	}
+
+	for i, replaceHostConfig := range content.Replace_host {
+		if _, err := replaceHostConfig.toHostReplacement(); err != nil {
+			return content.errorAt("replace_host", i, err)
+		}
+		if err := validateMetricPatterns(replaceHostConfig.Metrics); err != nil {
+			return content.errorAt("replace_host", i, err)
+		}
+	}
+
+	for i, renameConfig := range content.Rename {
+		if _, err := newRenameRule(renameConfig.From, renameConfig.To); err != nil {
+			return content.errorAt("rename", i, err)
+		}
+	}
+
+	return nil
+}
+
+func (tagsConfig *pruningConfigFileContentTagsConfig) validate() error {
+	for _, tag := range tagsConfig.Tags {
+		if _, err := parseTagMatcher(tag); err != nil {
+			return err
+		}
+	}
+	return tagsConfig.validateWhenAndMetrics()
+}
+
+func (tagsConfig *pruningConfigFileContentTagsConfig) validateWhenAndMetrics() error {
+	if tagsConfig.When != nil {
+		if err := tagsConfig.When.validate(); err != nil {
+			return err
+		}
+	}
+	return validateMetricPatterns(tagsConfig.Metrics)
+}
+
+func (onlyConfig *pruningConfigFileContentTagsConfig) validateOnly() error {
+	for _, tag := range onlyConfig.Tags {
+		if strings.Contains(tag, ":") {
+			return fmt.Errorf("tag values are not supported in tag allowlists: %v", tag)
+		}
+		if _, err := filepath.Match(tag, ""); err != nil {
+			return fmt.Errorf("invalid tag pattern %v: %v", tag, err)
+		}
+	}
+	return onlyConfig.validateWhenAndMetrics()
+}
+
+func (addConfig *pruningConfigFileContentTagsConfig) validateAdd() error {
+	for _, tag := range addConfig.Tags {
+		if name, _, _ := splitTag(tag); !isValidTagName(name) {
+			return fmt.Errorf("invalid static tag %#v", tag)
+		}
+	}
+	return addConfig.validateWhenAndMetrics()
+}
+
+func (renameConfig *pruningConfigFileContentTagRenameConfig) validate() error {
+	if !isValidTagName(renameConfig.From) || !isValidTagName(renameConfig.To) {
+		return fmt.Errorf("invalid tag rename from %#v to %#v", renameConfig.From, renameConfig.To)
+	}
+	return validateMetricPatterns(renameConfig.Metrics)
+}
+
+func (allowConfig *pruningConfigFileContentAllowConfig) validate() error {
+	if allowConfig.Namespace == "" {
+		return fmt.Errorf("no namespace for allowlist %v", allowConfig.Metrics)
+	}
+	if err := validateMetricPattern(allowConfig.Namespace); err != nil {
+		return err
+	}
+	return validateMetricPatterns(allowConfig.Metrics)
+}
+
+func (conditionalConfig *pruningConfigFileContentConditionalConfig) validate() error {
+	if len(conditionalConfig.Tags) == 0 && len(conditionalConfig.Type) == 0 && conditionalConfig.Device_name == "" {
+		return fmt.Errorf("no condition for conditional rule on %v", conditionalConfig.Metrics)
+	}
+	if _, err := conditionalConfig.toSeriesCondition(); err != nil {
+		return err
+	}
+	return validateMetricPatterns(conditionalConfig.Metrics)
+}
+
+func (aggregationConfig *pruningConfigFileContentAggregationConfig) validate() error {
+	if !isValidAggregation(aggregationConfig.Gauges) {
+		return fmt.Errorf("unknown aggregation for gauges: %#v", aggregationConfig.Gauges)
+	}
+	return validateMetricPatterns(aggregationConfig.Metrics)
+}
+
+// tag names used in renames or static tags can't be patterns
+func isValidTagName(name string) bool {
+	return name != "" && !strings.Contains(name, ":") && !isGlobPattern(name)
+}
+
+// metric patterns wrapped in slashes are regular expressions, e.g.
+// /^my_app\.http\.status_[45]xx$/
+func isRegexPattern(pattern string) bool {
+	return len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
+func compileRegexPattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile(pattern[1 : len(pattern)-1])
+}
+
+// segments other than `*` and `**` that contain any of these are glob
+// patterns, e.g. `*_count` or `query_[a-f]?`
+func isGlobSegment(segment string) bool {
+	return segment != "*" && segment != "**" && isGlobPattern(segment)
+}
+
+func isGlobPattern(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[\\")
+}
+
+func validateMetricPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if err := validateMetricPattern(pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateMetricPattern(pattern string) error {
+	if isRegexPattern(pattern) {
+		if _, err := compileRegexPattern(pattern); err != nil {
+			return fmt.Errorf("invalid regular expression %v: %v", pattern, err)
+		}
+		return nil
+	}
+
+	for _, segment := range strings.Split(pattern, ".") {
+		if isGlobSegment(segment) {
+			if _, err := filepath.Match(segment, ""); err != nil {
+				return fmt.Errorf("invalid pattern %v: %v", pattern, err)
+			}
+		}
+	}
 
 	return nil
 }
 
-func (config *PruningConfig) merge(content *pruningConfigFileContent) {
+func (config *PruningConfig) merge(content *pruningConfigFileContent) error {
+	if err := content.validate(); err != nil {
+		return err
+	}
+	if config.schedulable {
+		config.contents = append(config.contents, content)
+	}
+	if !config.applies(content.When, content.filename) {
+		logDebug("Skipping pruning config %v, its when clause doesn't currently apply", content.filename)
+		return nil
+	}
+
+	if config.rulePrecedence == PRECEDENCE_FILE_ORDER {
+		config.mergedFiles++
+	}
+
 	// metrics
-	for _, metric := range content.Metrics.Remove {
-		config.mergeNode(metric, &configValue{remove: true})
+	for i, metric := range content.Metrics.Remove {
+		origin := config.originFor(metric, content.Priority)
+		config.mergeNode(metric, &configValue{remove: true, removeOrigin: origin}, content.sourceOf("metrics.remove", i))
+	}
+	for i, metric := range content.Metrics.Keep {
+		origin := config.originFor(metric, content.Priority)
+		config.mergeNode(metric, &configValue{keep: true, keepOrigin: origin}, content.sourceOf("metrics.keep", i))
 	}
-	for _, metric := range content.Metrics.Keep {
-		config.mergeNode(metric, &configValue{keep: true})
+	for i, allowConfig := range content.Metrics.Allow {
+		source := content.sourceOf("metrics.allow", i)
+		namespace := map[string]bool{allowConfig.Namespace: true}
+		value := &configValue{restrictNamespaces: namespace}
+		if origin := config.originFor(allowConfig.Namespace, content.Priority); origin != nil {
+			value.restrictOrigins = map[string]*ruleOrigin{allowConfig.Namespace: origin}
+		}
+		config.mergeNode(allowConfig.Namespace, value, source)
+		for _, metric := range allowConfig.Metrics {
+			config.mergeNode(metric, &configValue{allowNamespaces: namespace}, source)
+		}
+	}
+	for i, conditionalConfig := range content.Metrics.Remove_if {
+		// conditions have been validated before merging
+		condition, _ := conditionalConfig.toSeriesCondition()
+		for _, metric := range conditionalConfig.Metrics {
+			value := &configValue{removeConditions: []*seriesCondition{condition}}
+			if origin := config.originFor(metric, content.Priority); origin != nil {
+				value.removeConditionOrigins = map[*seriesCondition]*ruleOrigin{condition: origin}
+			}
+			config.mergeNode(metric, value, content.sourceOf("metrics.remove_if", i))
+		}
 	}
 
 	// tags
-	config.mergeTags(content.Tags.Remove, false)
-	config.mergeTags(content.Tags.Keep, true)
+	config.mergeTags(content, "tags.remove", content.Tags.Remove, false)
+	config.mergeTags(content, "tags.keep", content.Tags.Keep, true)
+	for i, onlyConfig := range content.Tags.Only {
+		if !config.applies(onlyConfig.When, content.sourceOf("tags.only", i).String()) {
+			continue
+		}
+		tags := make(map[string]bool)
+		for _, tag := range onlyConfig.Tags {
+			tags[tag] = true
+		}
+		for _, metric := range onlyConfig.Metrics {
+			origin := config.originFor(metric, content.Priority)
+			config.mergeNode(metric, &configValue{onlyTags: tags, onlyTagsOrigin: origin}, content.sourceOf("tags.only", i))
+		}
+	}
+	for i, renameConfig := range content.Tags.Rename {
+		for _, metric := range renameConfig.Metrics {
+			renameTags := map[string]string{renameConfig.From: renameConfig.To}
+			config.mergeNode(metric, &configValue{renameTags: renameTags}, content.sourceOf("tags.rename", i))
+		}
+	}
+	for i, addConfig := range content.Tags.Add {
+		if !config.applies(addConfig.When, content.sourceOf("tags.add", i).String()) {
+			continue
+		}
+		tags := make(map[string]bool)
+		for _, tag := range addConfig.Tags {
+			tags[tag] = true
+		}
+		for _, metric := range addConfig.Metrics {
+			config.mergeNode(metric, &configValue{addTags: tags}, content.sourceOf("tags.add", i))
+		}
+	}
+
+	// aggregations
+	for i, aggregationConfig := range content.Aggregations {
+		for _, metric := range aggregationConfig.Metrics {
+			config.mergeNode(metric, &configValue{gaugeAggregation: aggregationConfig.Gauges}, content.sourceOf("aggregations", i))
+		}
+	}
+
+	// rewrites
+	for i, rewriteConfig := range content.Rewrite {
+		// rewrites have been validated before merging
+		rewrite, _ := rewriteConfig.toTagRewrite()
+		for _, metric := range rewriteConfig.Metrics {
+			config.mergeNode(metric, &configValue{tagRewrites: []*tagRewrite{rewrite}}, content.sourceOf("rewrite", i))
+		}
+	}
+
+	// host replacements
+	for i, replaceHostConfig := range content.Replace_host {
+		// replacements have been validated before merging
+		replacement, _ := replaceHostConfig.toHostReplacement()
+		for _, metric := range replaceHostConfig.Metrics {
+			config.mergeNode(metric, &configValue{hostReplacement: replacement}, content.sourceOf("replace_host", i))
+		}
+	}
+
+	// renames
+	for i, renameConfig := range content.Rename {
+		// renames have been validated before merging
+		rule, _ := newRenameRule(renameConfig.From, renameConfig.To)
+		rule.source = content.sourceOf("rename", i).withPattern(renameConfig.From)
+		config.renameRules = append(config.renameRules, rule)
+	}
+
+	return nil
+}
+
+func (rewriteConfig *pruningConfigFileContentRewriteConfig) toTagRewrite() (*tagRewrite, error) {
+	if rewriteConfig.Tag == "" {
+		return nil, fmt.Errorf("no tag for rewrite rule on %v", rewriteConfig.Metrics)
+	}
+	if _, err := filepath.Match(rewriteConfig.Tag, ""); err != nil {
+		return nil, fmt.Errorf("invalid tag pattern %v: %v", rewriteConfig.Tag, err)
+	}
+	if rewriteConfig.Pattern == "" && rewriteConfig.Truncate <= 0 {
+		return nil, fmt.Errorf("rewrite rule for tag %v should have either a pattern or a positive truncate value", rewriteConfig.Tag)
+	}
+
+	rewrite := &tagRewrite{
+		name:        rewriteConfig.Tag,
+		replacement: rewriteConfig.Replacement,
+		truncate:    rewriteConfig.Truncate,
+	}
+	if rewriteConfig.Pattern != "" {
+		regex, err := regexp.Compile(rewriteConfig.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %v: %v", rewriteConfig.Pattern, err)
+		}
+		rewrite.regex = regex
+	}
+
+	return rewrite, nil
 }
 
-func (config *PruningConfig) mergeTags(tagsConfigs []pruningConfigFileContentTagsConfig, keep bool) {
-	for _, metricsAndTags := range tagsConfigs {
+func (replaceHostConfig *pruningConfigFileContentReplaceHostConfig) toHostReplacement() (*hostReplacement, error) {
+	optionsCount := 0
+	for _, option := range []string{replaceHostConfig.Value, replaceHostConfig.Host_tag, replaceHostConfig.Pattern} {
+		if option != "" {
+			optionsCount++
+		}
+	}
+	if optionsCount != 1 {
+		return nil, fmt.Errorf("host replacement rule on %v should have exactly one of value, host_tag or pattern", replaceHostConfig.Metrics)
+	}
+
+	replacement := &hostReplacement{
+		value:       replaceHostConfig.Value,
+		hostTag:     replaceHostConfig.Host_tag,
+		replacement: replaceHostConfig.Replacement,
+	}
+	if replaceHostConfig.Pattern != "" {
+		regex, err := regexp.Compile(replaceHostConfig.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %v: %v", replaceHostConfig.Pattern, err)
+		}
+		replacement.regex = regex
+	}
+
+	return replacement, nil
+}
+
+func (conditionalConfig *pruningConfigFileContentConditionalConfig) toSeriesCondition() (*seriesCondition, error) {
+	condition := &seriesCondition{}
+
+	for _, tag := range conditionalConfig.Tags {
+		matcher, err := parseTagMatcher(tag)
+		if err != nil {
+			return nil, err
+		}
+		condition.tags = append(condition.tags, matcher)
+	}
+
+	if len(conditionalConfig.Type) != 0 {
+		condition.types = make(map[string]bool)
+		for _, metricType := range conditionalConfig.Type {
+			if !isValidMetricType(metricType) {
+				return nil, fmt.Errorf("unknown metric type: %#v", metricType)
+			}
+			condition.types[metricType] = true
+		}
+	}
+
+	if conditionalConfig.Device_name != "" {
+		var err error
+		if isRegexPattern(conditionalConfig.Device_name) {
+			condition.deviceName, err = compileRegexPattern(conditionalConfig.Device_name)
+		} else {
+			condition.deviceName, err = compileGlob(conditionalConfig.Device_name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid device name pattern %v: %v", conditionalConfig.Device_name, err)
+		}
+	}
+
+	return condition, nil
+}
+
+func (config *PruningConfig) mergeTags(content *pruningConfigFileContent, section string,
+	tagsConfigs []pruningConfigFileContentTagsConfig, keep bool) {
+
+	for i, metricsAndTags := range tagsConfigs {
+		if !config.applies(metricsAndTags.When, content.sourceOf(section, i).String()) {
+			continue
+		}
 		tags := make(map[string]bool)
+		tagPatterns := make(map[string]bool)
+		tagValues := make(map[string]*tagMatcher)
 		for _, tag := range metricsAndTags.Tags {
-			tags[tag] = true
+			if strings.Contains(tag, ":") {
+				// tag patterns have been validated before merging
+				tagValues[tag], _ = parseTagMatcher(tag)
+			} else if isGlobPattern(tag) {
+				tagPatterns[tag] = true
+			} else {
+				tags[tag] = true
+			}
 		}
 
 		for _, metric := range metricsAndTags.Metrics {
+			var tagOrigins map[string]*ruleOrigin
+			if origin := config.originFor(metric, content.Priority); origin != nil {
+				tagOrigins = make(map[string]*ruleOrigin)
+				for tag, _ := range tags {
+					tagOrigins[tag] = origin
+				}
+				for pattern, _ := range tagPatterns {
+					tagOrigins[pattern] = origin
+				}
+				for pattern, _ := range tagValues {
+					tagOrigins[pattern] = origin
+				}
+			}
+
 			var value configValue
 			if keep {
 				value = configValue{
-					keepTags:     tags,
-					keepHostTags: metricsAndTags.Host_tags,
+					keepTags:        tags,
+					keepTagPatterns: tagPatterns,
+					keepTagValues:   tagValues,
+					keepHostTags:    metricsAndTags.Host_tags,
+					keepTagOrigins:  tagOrigins,
 				}
 			} else {
 				value = configValue{
-					removeTags:     tags,
-					removeHostTags: metricsAndTags.Host_tags,
+					removeTags:        tags,
+					removeTagPatterns: tagPatterns,
+					removeTagValues:   tagValues,
+					removeHostTags:    metricsAndTags.Host_tags,
+					removeTagOrigins:  tagOrigins,
 				}
 			}
 
-			config.mergeNode(metric, &value)
+			config.mergeNode(metric, &value, content.sourceOf(section, i))
 		}
 	}
 }
 
-func (config *PruningConfig) mergeNode(metric string, value *configValue) {
+func (config *PruningConfig) mergeNode(metric string, value *configValue, source *ruleSource) {
+	source = source.withPattern(metric)
+	value.sources = []*ruleSource{source}
+	value.setSpecificity(metric)
+
+	if isRegexPattern(metric) {
+		// those don't get merged together, but can still conflict
+		for _, rule := range config.regexRules {
+			if rule.pattern == metric {
+				config.reportConflicts(metric, rule.value, value, source)
+			}
+		}
+
+		// patterns have been validated before merging
+		regex, _ := compileRegexPattern(metric)
+		config.regexRules = append(config.regexRules, &regexRule{pattern: metric, regex: regex, value: value})
+		return
+	}
+
 	currentNode := config.root
 	for _, key := range strings.Split(metric, ".") {
+		if isGlobSegment(key) {
+			currentNode = currentNode.globChild(key)
+			continue
+		}
+
 		newNode := currentNode.children[key]
 
 		if newNode == nil {
@@ -199,12 +998,26 @@ func (config *PruningConfig) mergeNode(metric string, value *configValue) {
 		currentNode = newNode
 	}
 
+	config.reportConflicts(metric, currentNode.value, value, source)
+
 	if currentNode.value == nil {
 		currentNode.value = newConfigValue()
 	}
 	currentNode.value.merge(value)
 }
 
+func (node *configNode) globChild(pattern string) *configNode {
+	for _, globChild := range node.globChildren {
+		if globChild.pattern == pattern {
+			return globChild.node
+		}
+	}
+
+	newNode := newConfigNode()
+	node.globChildren = append(node.globChildren, &globConfigNode{pattern: pattern, node: newNode})
+	return newNode
+}
+
 func (value *configValue) merge(other *configValue) {
 	if other == nil {
 		return
@@ -212,8 +1025,43 @@ func (value *configValue) merge(other *configValue) {
 
 	value.remove = value.remove || other.remove
 	value.keep = value.keep || other.keep
+	if other.removeOrigin != nil {
+		value.removeOrigin = strongestOrigin(value.removeOrigin, other.removeOrigin)
+	}
+	if other.keepOrigin != nil {
+		value.keepOrigin = strongestOrigin(value.keepOrigin, other.keepOrigin)
+	}
+	for namespace, _ := range other.restrictNamespaces {
+		value.restrictNamespaces[namespace] = true
+	}
+	for namespace, _ := range other.allowNamespaces {
+		value.allowNamespaces[namespace] = true
+	}
+	for namespace, origin := range other.restrictOrigins {
+		value.restrictOrigins[namespace] = strongestOrigin(value.restrictOrigins[namespace], origin)
+	}
+	for tag, origin := range other.removeTagOrigins {
+		value.removeTagOrigins[tag] = strongestOrigin(value.removeTagOrigins[tag], origin)
+	}
+	for tag, origin := range other.keepTagOrigins {
+		value.keepTagOrigins[tag] = strongestOrigin(value.keepTagOrigins[tag], origin)
+	}
+	if other.onlyTagsOrigin != nil {
+		value.onlyTagsOrigin = strongestOrigin(value.onlyTagsOrigin, other.onlyTagsOrigin)
+	}
+	for condition, origin := range other.removeConditionOrigins {
+		value.removeConditionOrigins[condition] = strongestOrigin(value.removeConditionOrigins[condition], origin)
+	}
 	value.removeHostTags = value.removeHostTags || other.removeHostTags
 	value.keepHostTags = value.keepHostTags || other.keepHostTags
+	if other.hostReplacement != nil && !value.hostReplacementOrigin.beats(other.hostReplacementOrigin) {
+		value.hostReplacement = other.hostReplacement
+		value.hostReplacementOrigin = other.hostReplacementOrigin
+	}
+	if other.gaugeAggregation != "" && !value.gaugeAggregationOrigin.beats(other.gaugeAggregationOrigin) {
+		value.gaugeAggregation = other.gaugeAggregation
+		value.gaugeAggregationOrigin = other.gaugeAggregationOrigin
+	}
 
 	if other.removeTags != nil {
 		for tag, _ := range other.removeTags {
@@ -225,38 +1073,246 @@ func (value *configValue) merge(other *configValue) {
 			value.keepTags[tag] = true
 		}
 	}
+	if other.removeTagPatterns != nil {
+		for pattern, _ := range other.removeTagPatterns {
+			value.removeTagPatterns[pattern] = true
+		}
+	}
+	if other.keepTagPatterns != nil {
+		for pattern, _ := range other.keepTagPatterns {
+			value.keepTagPatterns[pattern] = true
+		}
+	}
+	for pattern, matcher := range other.removeTagValues {
+		value.removeTagValues[pattern] = matcher
+	}
+	for pattern, matcher := range other.keepTagValues {
+		value.keepTagValues[pattern] = matcher
+	}
+
+	for tag, _ := range other.onlyTags {
+		value.onlyTags[tag] = true
+	}
+	for from, to := range other.renameTags {
+		if !value.renameTagOrigins[from].beats(other.renameTagOrigins[from]) {
+			value.renameTags[from] = to
+			value.renameTagOrigins[from] = other.renameTagOrigins[from]
+		}
+	}
+	if len(other.addTags) != 0 {
+		// static tags replace the ones with the same name
+		otherNames := make(map[string]bool)
+		for tag, _ := range other.addTags {
+			name, _, _ := splitTag(tag)
+			if !value.addTagOrigins[name].beats(other.addTagOrigins[name]) {
+				otherNames[name] = true
+			}
+		}
+		for tag, _ := range value.addTags {
+			if name, _, _ := splitTag(tag); otherNames[name] {
+				delete(value.addTags, tag)
+			}
+		}
+		for tag, _ := range other.addTags {
+			if name, _, _ := splitTag(tag); otherNames[name] {
+				value.addTags[tag] = true
+				value.addTagOrigins[name] = other.addTagOrigins[name]
+			}
+		}
+	}
+
+	for _, condition := range other.removeConditions {
+		value.addRemoveCondition(condition)
+	}
+	for _, source := range other.sources {
+		value.addSource(source)
+	}
+	for _, rewrite := range other.tagRewrites {
+		value.addTagRewrite(rewrite)
+	}
+}
+
+func (value *configValue) addRemoveCondition(condition *seriesCondition) {
+	for _, existingCondition := range value.removeConditions {
+		if existingCondition == condition {
+			return
+		}
+	}
+	value.removeConditions = append(value.removeConditions, condition)
+}
+
+func (value *configValue) addSource(source *ruleSource) {
+	for _, existingSource := range value.sources {
+		if existingSource == source {
+			return
+		}
+	}
+	value.sources = append(value.sources, source)
+}
+
+func (value *configValue) addTagRewrite(rewrite *tagRewrite) {
+	for _, existingRewrite := range value.tagRewrites {
+		if existingRewrite == rewrite {
+			return
+		}
+	}
+	value.tagRewrites = append(value.tagRewrites, rewrite)
 }
 
 func (configValue *configValue) toMetricPruningConfig() *MetricPruningConfig {
-	if configValue.remove && !configValue.keep {
+	// metrics in an allowlist namespace are removed unless explicitly allowed in
+	// that namespace
+	remove, removeOrigin := configValue.remove, configValue.removeOrigin
+	for namespace, _ := range configValue.restrictNamespaces {
+		if !configValue.allowNamespaces[namespace] {
+			remove = true
+			removeOrigin = strongestOrigin(removeOrigin, configValue.restrictOrigins[namespace])
+		}
+	}
+
+	if removeWins(remove, configValue.keep, removeOrigin, configValue.keepOrigin) {
 		return &MetricPruningConfig{Remove: true}
 	} else {
-		removeTags := make(map[string]bool)
+		var onlyTags []string
+		if len(configValue.onlyTags) != 0 {
+			onlyTags = sortedKeys(configValue.onlyTags)
+		}
 
+		rules := &tagRules{
+			removeTags:     configValue.removeTags,
+			keepTags:       configValue.keepTags,
+			removePatterns: sortedKeys(configValue.removeTagPatterns),
+			keepPatterns:   sortedKeys(configValue.keepTagPatterns),
+			removeValues:   sortedTagMatchers(configValue.removeTagValues),
+			keepValues:     sortedTagMatchers(configValue.keepTagValues),
+			onlyPatterns:   onlyTags,
+			removeOrigins:  configValue.removeTagOrigins,
+			keepOrigins:    configValue.keepTagOrigins,
+			onlyOrigin:     configValue.onlyTagsOrigin,
+			resolved:       make(map[string]*tagNameDecision),
+		}
+
+		removeTags := make(map[string]bool)
 		for tag, _ := range configValue.removeTags {
-			if !configValue.keepTags[tag] {
+			if rules.resolveName(tag).removes() {
 				removeTags[tag] = true
 			}
 		}
 
-		removeHost := removeTags["host"]
-		keepHostTags := removeHost && (configValue.keepHostTags || !configValue.removeHostTags)
+		metricPruningConfig := &MetricPruningConfig{
+			RemoveTags:       removeTags,
+			OnlyTags:         onlyTags,
+			GaugeAggregation: configValue.gaugeAggregation,
+			tagRewrites:      configValue.tagRewrites,
+		}
+
+		if len(configValue.removeTagPatterns) != 0 || len(configValue.removeTagValues) != 0 ||
+			len(configValue.keepTagValues) != 0 || len(configValue.onlyTags) != 0 {
+			metricPruningConfig.tagRules = rules
+		}
+
+		if len(configValue.renameTags) != 0 {
+			metricPruningConfig.RenameTags = make(map[string]string, len(configValue.renameTags))
+			for from, to := range configValue.renameTags {
+				metricPruningConfig.RenameTags[from] = to
+			}
+		}
+		if len(configValue.addTags) != 0 {
+			metricPruningConfig.AddTags = sortedKeys(configValue.addTags)
+		}
+
+		// `keep` rules also override conditional remove rules, unless the rule
+		// precedence says otherwise
+		for _, condition := range configValue.removeConditions {
+			if removeWins(true, configValue.keep, configValue.removeConditionOrigins[condition], configValue.keepOrigin) {
+				metricPruningConfig.removeConditions = append(metricPruningConfig.removeConditions, condition)
+			}
+		}
 
-		return &MetricPruningConfig{
-			RemoveTags:   removeTags,
-			RemoveHost:   removeHost,
-			KeepHostTags: keepHostTags,
+		metricPruningConfig.RemoveHost = metricPruningConfig.RemovesTag("host")
+		metricPruningConfig.hostValueRules = metricPruningConfig.tagRules != nil &&
+			metricPruningConfig.tagRules.resolveName("host").hasValueRules
+		removableHost := metricPruningConfig.RemoveHost || metricPruningConfig.hostValueRules
+		metricPruningConfig.KeepHostTags = removableHost &&
+			(configValue.keepHostTags || !configValue.removeHostTags)
+		if removableHost {
+			metricPruningConfig.hostReplacement = configValue.hostReplacement
 		}
+
+		return metricPruningConfig
+	}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key, _ := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedTagMatchers(matchers map[string]*tagMatcher) []*tagMatcher {
+	patterns := make([]string, 0, len(matchers))
+	for pattern, _ := range matchers {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	sorted := make([]*tagMatcher, 0, len(matchers))
+	for _, pattern := range patterns {
+		sorted = append(sorted, matchers[pattern])
 	}
+	return sorted
 }
 
 func newConfigNode() *configNode {
 	return &configNode{children: make(map[string]*configNode)}
 }
 
+// rules that don't go through the rule precedence are ranked by how specific
+// their pattern is; equally specific rules are won by the one merged last
+func (value *configValue) setSpecificity(pattern string) {
+	origin := &ruleOrigin{rank: patternSpecificity(pattern)}
+	if value.gaugeAggregation != "" {
+		value.gaugeAggregationOrigin = origin
+	}
+	if value.hostReplacement != nil {
+		value.hostReplacementOrigin = origin
+	}
+	if len(value.renameTags) != 0 {
+		value.renameTagOrigins = make(map[string]*ruleOrigin)
+		for from, _ := range value.renameTags {
+			value.renameTagOrigins[from] = origin
+		}
+	}
+	if len(value.addTags) != 0 {
+		value.addTagOrigins = make(map[string]*ruleOrigin)
+		for tag, _ := range value.addTags {
+			name, _, _ := splitTag(tag)
+			value.addTagOrigins[name] = origin
+		}
+	}
+}
+
 func newConfigValue() *configValue {
 	return &configValue{
-		removeTags: make(map[string]bool),
-		keepTags:   make(map[string]bool),
+		removeTags:             make(map[string]bool),
+		keepTags:               make(map[string]bool),
+		removeTagPatterns:      make(map[string]bool),
+		keepTagPatterns:        make(map[string]bool),
+		removeTagValues:        make(map[string]*tagMatcher),
+		keepTagValues:          make(map[string]*tagMatcher),
+		removeTagOrigins:       make(map[string]*ruleOrigin),
+		keepTagOrigins:         make(map[string]*ruleOrigin),
+		removeConditionOrigins: make(map[*seriesCondition]*ruleOrigin),
+		restrictNamespaces:     make(map[string]bool),
+		allowNamespaces:        make(map[string]bool),
+		restrictOrigins:        make(map[string]*ruleOrigin),
+		onlyTags:               make(map[string]bool),
+		renameTags:             make(map[string]string),
+		addTags:                make(map[string]bool),
+		renameTagOrigins:       make(map[string]*ruleOrigin),
+		addTagOrigins:          make(map[string]*ruleOrigin),
 	}
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"reflect"
 	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -155,6 +156,44 @@ func TestCaching(t *testing.T) {
 	}
 }
 
+// meant to be run with -race, too
+func TestConcurrentReset(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/1.yml")
+
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// removed by the first version, and stripped of some tags by
+				// the second one
+				metricPruningConfig := config.ConfigFor("my_app.some.max")
+				if !metricPruningConfig.Remove && !metricPruningConfig.RemoveTags["instance-type"] {
+					t.Errorf("Unexpected pruning config: %#v", metricPruningConfig)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		other := NewPruningConfig()
+		other.MergeWithFileOrGlob("test_fixtures/pruning_configs/" + strconv.Itoa(i%2+1) + ".yml")
+		config.Reset(other)
+	}
+	close(done)
+	wg.Wait()
+}
+
 func TestSeveralFiles(t *testing.T) {
 	configFromFull := NewPruningConfig()
 	configFromFull.MergeWithFileOrGlob("test_fixtures/pruning_configs/full.yml")
@@ -164,6 +203,10 @@ func TestSeveralFiles(t *testing.T) {
 		configFromPartials.MergeWithFileOrGlob("test_fixtures/pruning_configs/" + strconv.Itoa(i) + ".yml")
 	}
 
+	// rules naturally come from different places
+	clearRuleSources(configFromFull.root)
+	clearRuleSources(configFromPartials.root)
+
 	if !reflect.DeepEqual(configFromFull, configFromPartials) {
 		t.Errorf("Unexpectedly different configs:\n%#v\nVS\n%#v", configFromFull, configFromPartials)
 		// the above doesn't yield usable output when failing...
@@ -178,6 +221,9 @@ func TestGlob(t *testing.T) {
 	configFromGlob := NewPruningConfig()
 	configFromGlob.MergeWithFileOrGlob("test_fixtures/pruning_configs/[1-4].yml")
 
+	clearRuleSources(configFromFull.root)
+	clearRuleSources(configFromGlob.root)
+
 	if !reflect.DeepEqual(configFromFull, configFromGlob) {
 		t.Errorf("Unexpectedly different configs:\n%#v\nVS\n%#v", configFromFull, configFromGlob)
 		// the above doesn't yield usable output when failing...
@@ -275,8 +321,195 @@ func TestHostTags(t *testing.T) {
 	}
 }
 
+func TestRegexPatterns(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/regexes.yml")
+
+	for metric, expectedPruningConfig := range map[string]*MetricPruningConfig{
+		"my_app.http.status_4xx":     &MetricPruningConfig{Remove: true},
+		"my_app.http.status_5xx":     &MetricPruningConfig{Remove: true},
+		"my_app.http.status_2xx":     &MetricPruningConfig{RemoveTags: map[string]bool{}},
+		"my_app.http.status_4xx.avg": &MetricPruningConfig{RemoveTags: map[string]bool{}},
+		"legacy.a.b.p99":             &MetricPruningConfig{Remove: true},
+		"legacy.a.p999":              &MetricPruningConfig{Remove: true},
+		"legacy.a.p95":               &MetricPruningConfig{RemoveTags: map[string]bool{}},
+		"legacy.a.max":               &MetricPruningConfig{Remove: true},
+		// keep regexes override remove rules from the trie and vice versa
+		"legacy.important.a.p99": &MetricPruningConfig{RemoveTags: map[string]bool{}},
+		"legacy.important.max":   &MetricPruningConfig{RemoveTags: map[string]bool{}},
+		"my_app.db.query":        &MetricPruningConfig{RemoveTags: map[string]bool{"table": true}},
+		"other_app.my_app.db.a":  &MetricPruningConfig{RemoveTags: map[string]bool{}},
+	} {
+		if pruningConfig := config.ConfigFor(metric); !reflect.DeepEqual(pruningConfig, expectedPruningConfig) {
+			t.Errorf("Unexpected pruning config for %v: %#v", metric, pruningConfig)
+		}
+	}
+}
+
+func TestMostSpecificRuleWins(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/specificity.yml")
+
+	for metric, expectedAggregation := range map[string]string{
+		"my_app.workers.latency": AGGREGATION_MIN,
+		"my_app.requests":        AGGREGATION_SUM,
+		"my_app.workers.busy":    AGGREGATION_MAX,
+		"other_app.requests":     AGGREGATION_LAST,
+	} {
+		if aggregation := config.ConfigFor(metric).GaugeAggregation; aggregation != expectedAggregation {
+			t.Errorf("Unexpected gauge aggregation for %v: %v", metric, aggregation)
+		}
+	}
+
+	for metric, expectedRename := range map[string]string{
+		"my_app.workers.latency": "worker_db_host",
+		"my_app.requests":        "db_host",
+		"other_app.requests":     "other_db_host",
+	} {
+		if renameTags := config.ConfigFor(metric).RenameTags; renameTags["es_host"] != expectedRename {
+			t.Errorf("Unexpected renames for %v: %#v", metric, renameTags)
+		}
+	}
+
+	for metric, expectedTags := range map[string][]string{
+		"my_app.workers.latency": []string{"env:prod", "team:workers"},
+		"my_app.requests":        []string{"env:prod", "team:platform"},
+		"other_app.requests":     []string{"team:other"},
+	} {
+		if addTags := config.ConfigFor(metric).AddTags; !reflect.DeepEqual(expectedTags, addTags) {
+			t.Errorf("Unexpected static tags for %v: %#v", metric, addTags)
+		}
+	}
+
+	for metric, expectedHost := range map[string]string{
+		"my_app.workers.latency": "workers",
+		"my_app.requests":        "my-cluster",
+		"other_app.requests":     "other-cluster",
+	} {
+		if host, ok := config.ConfigFor(metric).ReplaceHost(map[string]interface{}{"host": "a"}, nil); !ok || host != expectedHost {
+			t.Errorf("Unexpected host replacement for %v: %v %v", metric, host, ok)
+		}
+	}
+}
+
+func TestInvalidRegexPattern(t *testing.T) {
+	config := NewPruningConfig()
+
+	output := WithCatpuredLogging(func() {
+		config.MergeWithFileOrGlob("test_fixtures/pruning_configs/invalid_regex.yml")
+	})
+
+	if !CheckLogLines(t, output, "WARN: Unable to load pruning config from test_fixtures/pruning_configs/invalid_regex.yml: test_fixtures/pruning_configs/invalid_regex.yml:7: invalid regular expression /^my_app\\.(db/: error parsing regexp: missing closing ): `^my_app\\.(db`") {
+		t.Errorf("Unexpected output: %v", output)
+	}
+
+	// none of the file's rules should have been merged
+	if pruningConfig := config.ConfigFor("my_app.a.max"); pruningConfig.Remove {
+		t.Errorf("Unexpected pruning config: %#v", pruningConfig)
+	}
+}
+
+func TestGlobPatterns(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/globs.yml")
+
+	for metric, expectedPruningConfig := range map[string]*MetricPruningConfig{
+		"my_app.requests_count":     &MetricPruningConfig{Remove: true},
+		"my_app._count":             &MetricPruningConfig{Remove: true},
+		"my_app.requests_count.avg": &MetricPruningConfig{RemoveTags: map[string]bool{}},
+		"my_app.requests_counts":    &MetricPruningConfig{RemoveTags: map[string]bool{}},
+		"my_app.db.query_time":      &MetricPruningConfig{Remove: true},
+		"my_app.db.query_avg":       &MetricPruningConfig{RemoveTags: map[string]bool{}},
+		"my_app.a.b.p95":            &MetricPruningConfig{Remove: true},
+		"my_app.a.b.p999":           &MetricPruningConfig{RemoveTags: map[string]bool{}},
+		"my_app.http.status_4xx":    &MetricPruningConfig{Remove: true},
+		"my_app.http.status_3xx":    &MetricPruningConfig{RemoveTags: map[string]bool{}},
+		"my_app.cache_hits.redis":   &MetricPruningConfig{RemoveTags: map[string]bool{"key": true}},
+		"my_app.cache_hits.redis.a": &MetricPruningConfig{RemoveTags: map[string]bool{}},
+		"my_app.cache.redis":        &MetricPruningConfig{RemoveTags: map[string]bool{}},
+		"other_app.requests_count":  &MetricPruningConfig{RemoveTags: map[string]bool{}},
+	} {
+		if pruningConfig := config.ConfigFor(metric); !reflect.DeepEqual(pruningConfig, expectedPruningConfig) {
+			t.Errorf("Unexpected pruning config for %v: %#v", metric, pruningConfig)
+		}
+	}
+
+	// glob segments shouldn't pollute the literal children
+	if _, present := config.root.children["my_app"].children["*_count"]; present {
+		t.Errorf("Unexpected literal child")
+	}
+}
+
+func TestInvalidGlobPattern(t *testing.T) {
+	config := NewPruningConfig()
+
+	if err := config.mergeWithFile("test_fixtures/pruning_configs/invalid_glob.yml"); err == nil || err.Error() != "test_fixtures/pruning_configs/invalid_glob.yml:3: invalid pattern my_app.status_[45xx: syntax error in pattern" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestTagPatterns(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/tag_patterns.yml")
+
+	pruningConfig := config.ConfigFor("my_app.my_metric")
+	for tag, expected := range map[string]bool{
+		"aws_region":          true,
+		"aws_account":         false,
+		"kube_deployment":     true,
+		"kube_namespace":      false,
+		"kube_namespace_name": false,
+		"pod_label_a":         true,
+		"pod_label_ab":        false,
+		"region":              true,
+		"host":                false,
+		"env":                 false,
+	} {
+		// twice, to make sure caching works as expected
+		for i := 0; i < 2; i++ {
+			if actual := pruningConfig.RemovesTag(tag); actual != expected {
+				t.Errorf("Unexpected result for tag %v: %v", tag, actual)
+			}
+		}
+	}
+	if pruningConfig.RemoveHost {
+		t.Errorf("Unexpected pruning config: %#v", pruningConfig)
+	}
+
+	// keep patterns also override exact remove rules
+	pruningConfig = config.ConfigFor("my_app.region")
+	if pruningConfig.RemovesTag("region") || !reflect.DeepEqual(pruningConfig.RemoveTags, map[string]bool{}) {
+		t.Errorf("Unexpected pruning config: %#v", pruningConfig)
+	}
+
+	// and patterns can remove the host
+	pruningConfig = config.ConfigFor("my_app.no_host")
+	if !pruningConfig.RemoveHost || !pruningConfig.KeepHostTags {
+		t.Errorf("Unexpected pruning config: %#v", pruningConfig)
+	}
+
+	// metrics with no pattern rules don't need to resolve anything
+	pruningConfig = config.ConfigFor("other_app.my_metric")
+	expectedPruningConfig := &MetricPruningConfig{RemoveTags: map[string]bool{}}
+	if !reflect.DeepEqual(pruningConfig, expectedPruningConfig) {
+		t.Errorf("Unexpected pruning config: %#v", pruningConfig)
+	}
+}
+
 // Private helpers
 
+func clearRuleSources(node *configNode) {
+	if node.value != nil {
+		node.value.sources = nil
+	}
+	for _, child := range node.children {
+		clearRuleSources(child)
+	}
+	for _, globChild := range node.globChildren {
+		clearRuleSources(globChild.node)
+	}
+}
+
 func compareConfigTrees(t *testing.T, expected, actual *configNode, currentPath string) {
 	if !reflect.DeepEqual(expected.value, actual.value) {
 		t.Errorf("Values differ at path %v: %#v VS %#v", currentPath, expected.value, actual.value)
@@ -307,3 +540,213 @@ func normalizePath(currentPath, key string) string {
 	newPath += key
 	return newPath
 }
+
+func TestAllowlists(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/allowlists.yml")
+
+	for metric, expectedRemove := range map[string]bool{
+		// allowed
+		"my_app.http.requests":  false,
+		"my_app.requests":       false,
+		"my_app.jobs.foo.count": false,
+		"other_app.db.queries":  false,
+		// not allowed
+		"my_app.unknown":        true,
+		"my_app.http.get.count": true,
+		"my_app.jobs.foo.max":   true,
+		"other_app.db.latency":  true,
+		// explicitly removed
+		"my_app.http.debug": true,
+		// explicitly kept
+		"my_app.special": false,
+		// outside of the allowlists' namespaces
+		"my_app":                   false,
+		"other_app.db.latency.p99": false,
+		"other_app.requests":       false,
+	} {
+		if pruningConfig := config.ConfigFor(metric); pruningConfig.Remove != expectedRemove {
+			t.Errorf("Unexpected pruning config for %v: %#v", metric, pruningConfig)
+		}
+	}
+}
+
+func TestOverlappingAllowlists(t *testing.T) {
+	config := NewPruningConfig()
+	config.mergeWithContent([]byte("metrics:\n  allow:\n    - namespace: my_app.**\n      metrics:\n      - my_app.requests\n      - my_app.payments.legacy\n"), "my_app.yml")
+	config.mergeWithContent([]byte("metrics:\n  allow:\n    - namespace: my_app.payments.**\n      metrics:\n      - my_app.payments.charges\n"), "payments.yml")
+
+	// metrics need to be allowed in all the namespaces they belong to
+	for metric, expectedRemove := range map[string]bool{
+		"my_app.requests":         false,
+		"my_app.payments.legacy":  true,
+		"my_app.payments.charges": true,
+		"my_app.unknown":          true,
+	} {
+		if pruningConfig := config.ConfigFor(metric); pruningConfig.Remove != expectedRemove {
+			t.Errorf("Unexpected pruning config for %v: %#v", metric, pruningConfig)
+		}
+	}
+
+	// the same namespace in different files is still the same namespace
+	config = NewPruningConfig()
+	config.mergeWithContent([]byte("metrics:\n  allow:\n    - namespace: my_app.**\n      metrics:\n      - my_app.requests\n"), "my_app.yml")
+	config.mergeWithContent([]byte("metrics:\n  allow:\n    - namespace: my_app.**\n      metrics:\n      - my_app.payments.*\n"), "payments.yml")
+	if pruningConfig := config.ConfigFor("my_app.payments.charges"); pruningConfig.Remove {
+		t.Errorf("Unexpected pruning config: %#v", pruningConfig)
+	}
+}
+
+func TestInvalidAllowlist(t *testing.T) {
+	config := NewPruningConfig()
+
+	err := config.mergeWithFile("test_fixtures/pruning_configs/invalid_allowlist.yml")
+	if err == nil || err.Error() != "test_fixtures/pruning_configs/invalid_allowlist.yml:5: no namespace for allowlist [my_app.requests]" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRulePrecedence(t *testing.T) {
+	loadConfig := func(precedence string) *PruningConfig {
+		config := NewPruningConfig()
+		config.rulePrecedence = precedence
+		config.MergeWithFileOrGlob("test_fixtures/pruning_configs/precedence/1.yml")
+		config.MergeWithFileOrGlob("test_fixtures/pruning_configs/precedence/2.yml")
+		return config
+	}
+
+	type expectations struct {
+		removedMetrics map[string]bool
+		// for my_app.http.requests
+		removedTags map[string]bool
+		// whether a my_app.http.requests series tagged with status:503 gets removed
+		removedSeries bool
+		// whether my_app.db.query loses its version tag to a tags.only rule
+		removedOnlyTag bool
+	}
+
+	for precedence, expected := range map[string]expectations{
+		PRECEDENCE_MERGE: {
+			removedMetrics: map[string]bool{
+				"my_app.debug.foo":         false,
+				"other_app.requests":       true,
+				"shared.important":         false,
+				"shared.other":             true,
+				"tie.metric":               false,
+				"my_app.requests":          false,
+				"strict_app.requests":      false,
+				"strict_app.foo.count":     false,
+				"strict_app.unknown":       true,
+				"strict_app.foo.bar.count": true,
+			},
+			removedTags: map[string]bool{"instance:1": false, "version:1": false, "aws_region:1": false,
+				"env:staging": false, "env:prod": false},
+		},
+		PRECEDENCE_MOST_SPECIFIC: {
+			removedMetrics: map[string]bool{
+				// my_app.debug.** is more specific than my_app.**
+				"my_app.debug.foo":   true,
+				"other_app.requests": true,
+				// shared.important is more specific than shared.*
+				"shared.important": false,
+				"shared.other":     true,
+				// ties are won by keep rules
+				"tie.metric":          false,
+				"my_app.requests":     false,
+				"strict_app.requests": false,
+				// strict_app.*.count is more specific than strict_app.**
+				"strict_app.foo.count":     false,
+				"strict_app.unknown":       true,
+				"strict_app.foo.bar.count": true,
+			},
+			// my_app.** is more specific than **, and my_app.http.* than my_app.**
+			removedTags: map[string]bool{"instance:1": true, "version:1": true, "aws_region:1": true,
+				"env:staging": true, "env:prod": false},
+			// my_app.http.* is more specific than my_app.**
+			removedSeries: true,
+			// my_app.db.* is more specific than my_app.**
+			removedOnlyTag: true,
+		},
+		PRECEDENCE_PRIORITY: {
+			removedMetrics: map[string]bool{
+				// 1.yml has a higher priority
+				"my_app.debug.foo":   true,
+				"other_app.requests": true,
+				"shared.important":   false,
+				"shared.other":       true,
+				// ties are won by keep rules
+				"tie.metric":          false,
+				"my_app.requests":     false,
+				"strict_app.requests": false,
+				// the allowlist comes from 1.yml
+				"strict_app.foo.count":     true,
+				"strict_app.unknown":       true,
+				"strict_app.foo.bar.count": true,
+			},
+			removedTags: map[string]bool{"instance:1": true, "version:1": false, "aws_region:1": true,
+				"env:staging": false, "env:prod": false},
+			removedSeries: true,
+		},
+		PRECEDENCE_FILE_ORDER: {
+			removedMetrics: map[string]bool{
+				// 2.yml is loaded last
+				"my_app.debug.foo":   false,
+				"other_app.requests": true,
+				"shared.important":   true,
+				"shared.other":       true,
+				// ties are won by keep rules
+				"tie.metric":               false,
+				"my_app.requests":          false,
+				"strict_app.requests":      false,
+				"strict_app.foo.count":     false,
+				"strict_app.unknown":       true,
+				"strict_app.foo.bar.count": true,
+			},
+			removedTags: map[string]bool{"instance:1": false, "version:1": true, "aws_region:1": false,
+				"env:staging": true, "env:prod": false},
+			removedOnlyTag: true,
+		},
+	} {
+		t.Run(precedence, func(t *testing.T) {
+			config := loadConfig(precedence)
+
+			for metric, expectedRemove := range expected.removedMetrics {
+				if pruningConfig := config.ConfigFor(metric); pruningConfig.Remove != expectedRemove {
+					t.Errorf("Unexpected pruning config for %v: %#v", metric, pruningConfig)
+				}
+			}
+
+			pruningConfig := config.ConfigFor("my_app.http.requests")
+			for tag, expectedRemove := range expected.removedTags {
+				if actual := pruningConfig.RemovesTag(tag); actual != expectedRemove {
+					t.Errorf("Unexpected decision for tag %v: %v", tag, actual)
+				}
+			}
+
+			series := map[string]interface{}{"tags": []interface{}{"status:503"}}
+			if actual := pruningConfig.RemovesSeries(series); actual != expected.removedSeries {
+				t.Errorf("Unexpected decision for series: %v", actual)
+			}
+
+			if actual := config.ConfigFor("my_app.db.query").RemovesTag("version:1"); actual != expected.removedOnlyTag {
+				t.Errorf("Unexpected decision for the version tag on my_app.db.query: %v", actual)
+			}
+		})
+	}
+
+	t.Run("it doesn't depend on the order of rules within a file", func(t *testing.T) {
+		for _, precedence := range []string{PRECEDENCE_MOST_SPECIFIC, PRECEDENCE_PRIORITY} {
+			config := NewPruningConfig()
+			config.rulePrecedence = precedence
+			config.MergeWithFileOrGlob("test_fixtures/pruning_configs/precedence/2.yml")
+			config.MergeWithFileOrGlob("test_fixtures/pruning_configs/precedence/1.yml")
+
+			expected := loadConfig(precedence)
+			for _, metric := range []string{"my_app.debug.foo", "shared.important", "strict_app.foo.count"} {
+				if actual := config.ConfigFor(metric); !reflect.DeepEqual(expected.ConfigFor(metric), actual) {
+					t.Errorf("Unexpected pruning config for %v with %v: %#v", metric, precedence, actual)
+				}
+			}
+		}
+	})
+}
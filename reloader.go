@@ -0,0 +1,117 @@
+package main
+
+import "sync"
+
+// reloads the config on SIGHUP, and applies whatever changed
+type k9ReloaderShutdowner struct {
+	config      *Config
+	transformer *DDTransformer
+	proxy       *HttpProxy
+	// nil if no credentials are configured
+	hostTags *HostTags
+	// nil if not in gateway mode
+	gateway *Gateway
+	// reloads can be triggered both by signals and by ConfigWatcher
+	mutex sync.Mutex
+}
+
+func newK9ReloaderShutdowner(config *Config, transformer *DDTransformer, proxy *HttpProxy) *k9ReloaderShutdowner {
+	reloaderShutdowner := &k9ReloaderShutdowner{
+		config:      config,
+		transformer: transformer,
+		proxy:       proxy,
+	}
+
+	reloaderShutdowner.resetHostTags()
+	if config.GatewayMode {
+		reloaderShutdowner.startGateway()
+	}
+
+	return reloaderShutdowner
+}
+
+func (reloaderShutdowner *k9ReloaderShutdowner) Reload() {
+	reloaderShutdowner.mutex.Lock()
+	defer reloaderShutdowner.mutex.Unlock()
+
+	previousConfig := reloaderShutdowner.config.settings()
+	reloaderShutdowner.config.Reload()
+	reloaderShutdowner.apply(previousConfig, reloaderShutdowner.config.settings())
+}
+
+func (reloaderShutdowner *k9ReloaderShutdowner) WatchedPaths() []string {
+	reloaderShutdowner.mutex.Lock()
+	defer reloaderShutdowner.mutex.Unlock()
+
+	return reloaderShutdowner.config.WatchedPaths()
+}
+
+func (reloaderShutdowner *k9ReloaderShutdowner) Shutdown() {
+	reloaderShutdowner.config.RemotePruningConfigs.StopPolling()
+	reloaderShutdowner.proxy.Stop()
+	if reloaderShutdowner.gateway != nil {
+		reloaderShutdowner.gateway.Stop()
+	}
+	if reloaderShutdowner.hostTags != nil {
+		reloaderShutdowner.hostTags.Stop()
+	}
+}
+
+// applies the changes between the previous settings and the current ones; both
+// are copies, since other goroutines keep reading the live config
+func (reloaderShutdowner *k9ReloaderShutdowner) apply(previousConfig, config *Config) {
+	if config.DdUrl != previousConfig.DdUrl {
+		logInfo("Now forwarding requests to %v", config.DdUrl)
+		reloaderShutdowner.proxy.SetTarget(config.DdUrl)
+	}
+
+	if config.DdUrl != previousConfig.DdUrl || config.ApiKey != previousConfig.ApiKey ||
+		config.ApplicationKey != previousConfig.ApplicationKey {
+		reloaderShutdowner.resetHostTags()
+	}
+
+	if config.ListenPort != previousConfig.ListenPort {
+		if err := reloaderShutdowner.proxy.Rebind(config.ListenPort); err != nil {
+			logError("Unable to listen on port %v, still listening on port %v: %v", config.ListenPort, previousConfig.ListenPort, err)
+			reloaderShutdowner.config.setListenPort(previousConfig.ListenPort)
+		}
+	}
+
+	switch {
+	case config.GatewayMode && reloaderShutdowner.gateway == nil:
+		reloaderShutdowner.startGateway()
+	case !config.GatewayMode && reloaderShutdowner.gateway != nil:
+		logInfo("Leaving gateway mode")
+		reloaderShutdowner.proxy.RemoveInterceptor(reloaderShutdowner.gateway)
+		reloaderShutdowner.gateway.Stop()
+		reloaderShutdowner.gateway = nil
+	case config.GatewayMode:
+		reloaderShutdowner.gateway.Reconfigure(config.ApiKey, config.GatewayFlushInterval, config.GatewayGracePeriod)
+	}
+}
+
+// (re)builds the host tags retriever from the current credentials
+func (reloaderShutdowner *k9ReloaderShutdowner) resetHostTags() {
+	if reloaderShutdowner.hostTags != nil {
+		reloaderShutdowner.hostTags.Stop()
+		reloaderShutdowner.hostTags = nil
+	}
+
+	config := reloaderShutdowner.config.settings()
+	if config.ApiKey != "" && config.ApplicationKey != "" {
+		reloaderShutdowner.hostTags = NewHostsTags(config.DdUrl, config.ApiKey, config.ApplicationKey, nil)
+		reloaderShutdowner.transformer.SetHostTags(reloaderShutdowner.hostTags)
+		reloaderShutdowner.config.SetHostTags(reloaderShutdowner.hostTags)
+	} else {
+		// careful not to set a nil *HostTags as a non-nil HostTagsRetriever
+		reloaderShutdowner.transformer.SetHostTags(nil)
+		reloaderShutdowner.config.SetHostTags(nil)
+	}
+}
+
+func (reloaderShutdowner *k9ReloaderShutdowner) startGateway() {
+	config := reloaderShutdowner.config.settings()
+	reloaderShutdowner.gateway = NewGateway(reloaderShutdowner.proxy, reloaderShutdowner.transformer,
+		config.ApiKey, config.GatewayFlushInterval, config.GatewayGracePeriod)
+	reloaderShutdowner.gateway.Start()
+}
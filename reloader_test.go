@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloaderAppliesAllChanges(t *testing.T) {
+	previousLogLevel := setLogLevel(FATAL)
+	defer setLogLevel(previousLogLevel)
+
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			responseWriter.Write([]byte(name))
+		}))
+	}
+	backend1, backend2 := newBackend("backend 1"), newBackend("backend 2")
+	defer backend1.Close()
+	defer backend2.Close()
+
+	tempFile, err := ioutil.TempFile("/tmp", "k9-test-reloader-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+
+	writeConfig := func(port int, ddUrl string, gatewayMode bool) {
+		content := fmt.Sprintf("listen_port: %v\ndd_url: %v\ngateway_mode: %v\ngateway_flush_interval: 5\n", port, ddUrl, gatewayMode)
+		if err := ioutil.WriteFile(tempPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	post := func(port int, path string) (int, string, error) {
+		response, err := client.Post("http://localhost:"+strconv.Itoa(port)+path, "application/json", strings.NewReader(`{"series": []}`))
+		if err != nil {
+			return 0, "", err
+		}
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		return response.StatusCode, string(body), err
+	}
+
+	assertProxiesTo := func(t *testing.T, port int, expectedBody string) {
+		_, body, err := post(port, "/ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != expectedBody {
+			t.Errorf("Unexpected body: %v", body)
+		}
+	}
+
+	port1, port2 := GetFreePort(), GetFreePort()
+	writeConfig(port1, backend1.URL, false)
+
+	config := NewConfig(tempPath, "")
+	transformer := NewTransformer(config.PruningConfig, nil)
+	proxy := NewProxy(config.DdUrl, transformer)
+	reloaderShutdowner := newK9ReloaderShutdowner(config, transformer, proxy)
+	proxy.Start(config.ListenPort)
+	defer reloaderShutdowner.Shutdown()
+	if !WaitForPort(port1) {
+		t.Fatalf("Not listening on port %v", port1)
+	}
+
+	assertProxiesTo(t, port1, "backend 1")
+
+	t.Run("it retargets the proxy, rebinds the listener and starts the gateway", func(t *testing.T) {
+		writeConfig(port2, backend2.URL, true)
+		reloaderShutdowner.Reload()
+		if !WaitForPort(port2) {
+			t.Fatalf("Not listening on port %v", port2)
+		}
+
+		assertProxiesTo(t, port2, "backend 2")
+
+		if reloaderShutdowner.gateway == nil || reloaderShutdowner.gateway.flushInterval != 5*time.Second {
+			t.Fatalf("Expected the gateway to be started: %#v", reloaderShutdowner.gateway)
+		}
+		if statusCode, _, _ := post(port2, "/api/v1/series/"); statusCode != http.StatusAccepted {
+			t.Errorf("Expected the gateway to intercept series: %v", statusCode)
+		}
+
+		// the previous listener should eventually be closed
+		for i := 0; ; i++ {
+			if _, _, err := post(port1, "/ping"); err != nil {
+				break
+			}
+			if i == 50 {
+				t.Fatalf("Still listening on port %v", port1)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("it stops the gateway", func(t *testing.T) {
+		writeConfig(port2, backend2.URL, false)
+		reloaderShutdowner.Reload()
+
+		if reloaderShutdowner.gateway != nil {
+			t.Errorf("Expected the gateway to be stopped")
+		}
+		if _, body, _ := post(port2, "/api/v1/series/"); body != "backend 2" {
+			t.Errorf("Expected series to be proxied: %v", body)
+		}
+	})
+
+	t.Run("it keeps listening on the previous port if it can't bind the new one", func(t *testing.T) {
+		listener, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		busyPort := listener.Addr().(*net.TCPAddr).Port
+
+		writeConfig(busyPort, backend2.URL, false)
+		reloaderShutdowner.Reload()
+
+		if config.ListenPort != port2 {
+			t.Errorf("Unexpected listen port: %v", config.ListenPort)
+		}
+		assertProxiesTo(t, port2, "backend 2")
+	})
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_REMOTE_PRUNING_CONFIGS_CACHE_DIR     = "/var/cache/k9"
+	DEFAULT_REMOTE_PRUNING_CONFIGS_POLL_INTERVAL = 1 * time.Minute
+)
+
+// pruning configs fetched over HTTP(S); the last good version of each gets
+// cached on disk, so that k9 can still start with its rules if the server is
+// down. The cache dir is given by the config being loaded, while the URLs to
+// poll only change once a config has been successfully loaded, see configure
+type RemotePruningConfigs struct {
+	client *http.Client
+
+	mutex        sync.Mutex
+	pollInterval time.Duration
+	sources      map[string]*remotePruningConfig
+	// URLs fetched while loading a config, that aren't polled yet
+	pending map[string]*remotePruningConfig
+	// nil when not polling
+	done    chan bool
+	stopped chan bool
+}
+
+type remotePruningConfig struct {
+	url          string
+	etag         string
+	lastModified string
+	// the last version fetched, nil if none
+	content []byte
+}
+
+func NewRemotePruningConfigs() *RemotePruningConfigs {
+	return &RemotePruningConfigs{
+		client:       &http.Client{Timeout: HTTP_TIMEOUT},
+		pollInterval: DEFAULT_REMOTE_PRUNING_CONFIGS_POLL_INTERVAL,
+		sources:      make(map[string]*remotePruningConfig),
+		pending:      make(map[string]*remotePruningConfig),
+	}
+}
+
+func isRemotePruningConfig(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// to be called once a config has been successfully loaded; starts polling the
+// new URLs, and forgets about the ones that aren't used any more
+func (remotes *RemotePruningConfigs) configure(pollInterval time.Duration, paths []string) {
+	remotes.mutex.Lock()
+	defer remotes.mutex.Unlock()
+
+	remotes.pollInterval = DEFAULT_REMOTE_PRUNING_CONFIGS_POLL_INTERVAL
+	if pollInterval > 0 {
+		remotes.pollInterval = pollInterval
+	}
+
+	sources := make(map[string]*remotePruningConfig)
+	for _, path := range paths {
+		if !isRemotePruningConfig(path) {
+			continue
+		}
+		if source := remotes.sources[path]; source != nil {
+			sources[path] = source
+		} else if source := remotes.pending[path]; source != nil {
+			sources[path] = source
+		} else {
+			sources[path] = &remotePruningConfig{url: path}
+		}
+	}
+	remotes.sources = sources
+	remotes.pending = make(map[string]*remotePruningConfig)
+}
+
+// returns the latest version of the given pruning config; if it can't be
+// fetched, falls back to the last version fetched, or failing that to the one
+// cached on disk in the given dir
+func (remotes *RemotePruningConfigs) fetch(url, cacheDir string) ([]byte, error) {
+	source := remotes.source(url)
+
+	if _, err := remotes.update(source); err != nil {
+		remotes.mutex.Lock()
+		defer remotes.mutex.Unlock()
+
+		if source.content == nil {
+			cachedContent, cacheErr := ioutil.ReadFile(cachePathFor(cacheDir, url))
+			if cacheErr != nil {
+				return nil, err
+			}
+			source.content = cachedContent
+		}
+
+		logWarn("Unable to fetch pruning config from %v, using the last version fetched: %v", url, err)
+		return source.content, nil
+	}
+
+	remotes.mutex.Lock()
+	defer remotes.mutex.Unlock()
+	return source.content, nil
+}
+
+// to be called once the given content has been successfully loaded
+func (remotes *RemotePruningConfigs) saveToCache(url, cacheDir string, content []byte) {
+	cachePath := cachePathFor(cacheDir, url)
+	if cachedContent, err := ioutil.ReadFile(cachePath); err == nil && bytes.Equal(cachedContent, content) {
+		return
+	}
+
+	// write to a temp file first, so that we never leave a truncated file behind
+	err := os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(cachePath+".tmp", content, 0644)
+	}
+	if err == nil {
+		err = os.Rename(cachePath+".tmp", cachePath)
+	}
+	if err != nil {
+		logWarn("Unable to cache pruning config from %v at %v: %v", url, cachePath, err)
+	}
+}
+
+// polls all the remote pruning configs, and calls onChange whenever any of
+// them has changed; non-blocking, see StopPolling
+func (remotes *RemotePruningConfigs) Poll(onChange func()) {
+	done, stopped := make(chan bool), make(chan bool)
+	remotes.mutex.Lock()
+	remotes.done, remotes.stopped = done, stopped
+	remotes.mutex.Unlock()
+
+	go func() {
+		defer close(stopped)
+
+		for {
+			remotes.mutex.Lock()
+			timer := time.NewTimer(remotes.pollInterval)
+			remotes.mutex.Unlock()
+
+			select {
+			case <-timer.C:
+			case <-done:
+				timer.Stop()
+				return
+			}
+
+			// the URLs might have changed while waiting, e.g. on reloads
+			changed := false
+			for _, source := range remotes.currentSources() {
+				sourceChanged, err := remotes.update(source)
+				if err != nil {
+					logWarn("Unable to fetch pruning config from %v: %v", source.url, err)
+				}
+				changed = changed || sourceChanged
+			}
+
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			if changed {
+				logInfo("Remote pruning configs changed, reloading")
+				onChange()
+			}
+		}
+	}()
+}
+
+// returns once the polling goroutine has exited; a no-op if not polling
+func (remotes *RemotePruningConfigs) StopPolling() {
+	remotes.mutex.Lock()
+	done, stopped := remotes.done, remotes.stopped
+	remotes.done, remotes.stopped = nil, nil
+	remotes.mutex.Unlock()
+
+	if done == nil {
+		return
+	}
+	close(done)
+	<-stopped
+}
+
+// Private helpers
+
+func (remotes *RemotePruningConfigs) source(url string) *remotePruningConfig {
+	remotes.mutex.Lock()
+	defer remotes.mutex.Unlock()
+
+	source := remotes.sources[url]
+	if source == nil {
+		source = remotes.pending[url]
+	}
+	if source == nil {
+		source = &remotePruningConfig{url: url}
+		remotes.pending[url] = source
+	}
+	return source
+}
+
+func (remotes *RemotePruningConfigs) currentSources() []*remotePruningConfig {
+	remotes.mutex.Lock()
+	defer remotes.mutex.Unlock()
+
+	sources := make([]*remotePruningConfig, 0, len(remotes.sources))
+	for _, source := range remotes.sources {
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+func cachePathFor(cacheDir, url string) string {
+	return filepath.Join(cacheDir, fmt.Sprintf("%x.yml", sha256.Sum256([]byte(url))))
+}
+
+// makes a conditional request for the given pruning config, and returns
+// whether its content has changed
+func (remotes *RemotePruningConfigs) update(source *remotePruningConfig) (bool, error) {
+	request, err := http.NewRequest("GET", source.url, nil)
+	if err != nil {
+		return false, err
+	}
+
+	remotes.mutex.Lock()
+	if source.content != nil {
+		if source.etag != "" {
+			request.Header.Set("If-None-Match", source.etag)
+		}
+		if source.lastModified != "" {
+			request.Header.Set("If-Modified-Since", source.lastModified)
+		}
+	}
+	remotes.mutex.Unlock()
+
+	response, err := remotes.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if response.StatusCode > 299 {
+		return false, errors.New("status code: " + strconv.Itoa(response.StatusCode))
+	}
+
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return false, err
+	}
+
+	remotes.mutex.Lock()
+	defer remotes.mutex.Unlock()
+
+	changed := !bytes.Equal(content, source.content)
+	source.content = content
+	source.etag = response.Header.Get("ETag")
+	source.lastModified = response.Header.Get("Last-Modified")
+
+	return changed, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serves a pruning config, with an ETag
+type testPruningConfigServer struct {
+	*httptest.Server
+
+	mutex        sync.Mutex
+	content      string
+	version      int
+	requests     int
+	notModifieds int
+}
+
+func newTestPruningConfigServer(content string) *testPruningConfigServer {
+	server := &testPruningConfigServer{content: content}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+
+		server.requests++
+		etag := fmt.Sprintf(`"v%v"`, server.version)
+		if request.Header.Get("If-None-Match") == etag {
+			server.notModifieds++
+			responseWriter.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		responseWriter.Header().Set("ETag", etag)
+		responseWriter.Write([]byte(server.content))
+	}))
+	return server
+}
+
+func (server *testPruningConfigServer) setContent(content string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.content = content
+	server.version++
+}
+
+func (server *testPruningConfigServer) counts() (int, int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.requests, server.notModifieds
+}
+
+func newTestRemotePruningConfigs(t *testing.T, url string) (*RemotePruningConfigs, string) {
+	cacheDir, err := ioutil.TempDir("/tmp", "k9-test-remote-pruning-configs-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remotes := NewRemotePruningConfigs()
+	remotes.configure(0, []string{url})
+	return remotes, cacheDir
+}
+
+func TestRemotePruningConfigsFetch(t *testing.T) {
+	server := newTestPruningConfigServer("metrics:\n  remove:\n    - my_app.debug\n")
+	defer server.Close()
+	url := server.URL + "/k9.yml"
+
+	remotes, cacheDir := newTestRemotePruningConfigs(t, url)
+	defer os.RemoveAll(cacheDir)
+
+	assertFetches := func(t *testing.T, remotes *RemotePruningConfigs, expected string) {
+		content, err := remotes.fetch(url, cacheDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("Unexpected content: %q", content)
+		}
+	}
+
+	t.Run("it fetches the config, then only re-downloads it if it has changed", func(t *testing.T) {
+		assertFetches(t, remotes, "metrics:\n  remove:\n    - my_app.debug\n")
+		assertFetches(t, remotes, "metrics:\n  remove:\n    - my_app.debug\n")
+		if requests, notModifieds := server.counts(); requests != 2 || notModifieds != 1 {
+			t.Errorf("Unexpected requests: %v, of which not modified: %v", requests, notModifieds)
+		}
+
+		server.setContent("metrics:\n  remove:\n    - my_app.trace\n")
+		assertFetches(t, remotes, "metrics:\n  remove:\n    - my_app.trace\n")
+		if requests, notModifieds := server.counts(); requests != 3 || notModifieds != 1 {
+			t.Errorf("Unexpected requests: %v, of which not modified: %v", requests, notModifieds)
+		}
+	})
+
+	t.Run("it only caches configs on disk once told they're valid", func(t *testing.T) {
+		if _, err := os.Stat(cachePathFor(cacheDir, url)); !os.IsNotExist(err) {
+			t.Errorf("Expected no cached config, got: %v", err)
+		}
+
+		remotes.saveToCache(url, cacheDir, []byte("metrics:\n  remove:\n    - my_app.trace\n"))
+		remotes.saveToCache(url, cacheDir, []byte("metrics:\n  remove:\n    - my_app.trace\n"))
+
+		matches, _ := filepath.Glob(filepath.Join(cacheDir, "*"))
+		if len(matches) != 1 {
+			t.Errorf("Unexpected cache content: %v", matches)
+		}
+	})
+
+	t.Run("when the server is down, it falls back to the last version fetched", func(t *testing.T) {
+		server.Close()
+
+		output := WithCatpuredLogging(func() {
+			assertFetches(t, remotes, "metrics:\n  remove:\n    - my_app.trace\n")
+		})
+		CheckLogLines(t, output, "WARN: Unable to fetch pruning config from "+url+", using the last version fetched: "+
+			"Get \""+url+"\": dial tcp "+server.Listener.Addr().String()+": connect: connection refused")
+
+		// a fresh instance has to use the disk cache
+		freshRemotes := NewRemotePruningConfigs()
+		freshRemotes.configure(0, []string{url})
+		WithCatpuredLogging(func() {
+			assertFetches(t, freshRemotes, "metrics:\n  remove:\n    - my_app.trace\n")
+		})
+
+		// and fails with no cache at all
+		emptyRemotes, emptyCacheDir := newTestRemotePruningConfigs(t, url)
+		defer os.RemoveAll(emptyCacheDir)
+		if _, err := emptyRemotes.fetch(url, emptyCacheDir); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
+
+func TestRemotePruningConfigsPoll(t *testing.T) {
+	server := newTestPruningConfigServer("metrics: {}")
+	defer server.Close()
+	url := server.URL + "/k9.yml"
+
+	remotes, cacheDir := newTestRemotePruningConfigs(t, url)
+	defer os.RemoveAll(cacheDir)
+	remotes.pollInterval = 10 * time.Millisecond
+	if _, err := remotes.fetch(url, cacheDir); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := make(chan bool, 10)
+	WithCatpuredLogging(func() {
+		remotes.Poll(func() { changes <- true })
+		defer remotes.StopPolling()
+
+		// nothing changed so far
+		time.Sleep(50 * time.Millisecond)
+		if len(changes) != 0 {
+			t.Errorf("Unexpected changes: %v", len(changes))
+		}
+		if requests, notModifieds := server.counts(); requests < 2 || notModifieds != requests-1 {
+			t.Errorf("Unexpected requests: %v, of which not modified: %v", requests, notModifieds)
+		}
+
+		server.setContent("metrics:\n  remove:\n    - my_app.debug\n")
+		select {
+		case <-changes:
+		case <-time.After(time.Second):
+			t.Error("Timed out waiting for the change")
+		}
+
+		// it picks up URLs changed on reloads
+		otherServer := newTestPruningConfigServer("metrics: {}")
+		defer otherServer.Close()
+		remotes.configure(10*time.Millisecond, []string{otherServer.URL + "/k9.yml"})
+		time.Sleep(50 * time.Millisecond)
+		requests, _ := server.counts()
+		time.Sleep(50 * time.Millisecond)
+		if newRequests, _ := server.counts(); newRequests != requests {
+			t.Errorf("Still polling a removed URL: %v requests, then %v", requests, newRequests)
+		}
+		if otherRequests, _ := otherServer.counts(); otherRequests == 0 {
+			t.Error("Expected the new URL to be polled")
+		}
+
+		// and stops polling altogether
+		remotes.StopPolling()
+		otherRequests, _ := otherServer.counts()
+		time.Sleep(50 * time.Millisecond)
+		if newOtherRequests, _ := otherServer.counts(); newOtherRequests != otherRequests {
+			t.Errorf("Still polling after being stopped: %v requests, then %v", otherRequests, newOtherRequests)
+		}
+	})
+}
+
+func TestConfigWithRemotePruningConfigs(t *testing.T) {
+	server := newTestPruningConfigServer("metrics:\n  remove:\n    - my_app.debug\n")
+	defer server.Close()
+	url := server.URL + "/k9.yml"
+
+	dir, err := ioutil.TempDir("/tmp", "k9-test-config-remote-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "k9.yml")
+	configContent := fmt.Sprintf("pruning_configs:\n  - %v\nremote_pruning_configs_cache_dir: %v\n", url, filepath.Join(dir, "cache"))
+	if err := ioutil.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := NewConfig(configPath, "")
+	if !config.PruningConfig.ConfigFor("my_app.debug").Remove {
+		t.Error("Expected my_app.debug to be removed")
+	}
+	if watchedPaths := config.WatchedPaths(); len(watchedPaths) != 1 || watchedPaths[0] != configPath {
+		t.Errorf("Unexpected watched paths: %v", watchedPaths)
+	}
+
+	// even with the server down, a fresh instance starts with the cached rules
+	server.Close()
+	WithCatpuredLogging(func() {
+		config = NewConfig(configPath, "")
+	})
+	if !config.PruningConfig.ConfigFor("my_app.debug").Remove {
+		t.Error("Expected my_app.debug to be removed")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import "strings"
+
+// how conflicting `remove` and `keep` rules get resolved
+const (
+	// all matching rules get merged, and `keep` rules always win
+	PRECEDENCE_MERGE = "merge"
+	// the rule with the most specific metric pattern wins
+	PRECEDENCE_MOST_SPECIFIC = "most_specific"
+	// the rule from the pruning config with the highest priority wins
+	PRECEDENCE_PRIORITY = "priority"
+	// the rule from the pruning config loaded last wins
+	PRECEDENCE_FILE_ORDER = "file_order"
+)
+
+const DEFAULT_RULE_PRECEDENCE = PRECEDENCE_MERGE
+
+func isValidRulePrecedence(precedence string) bool {
+	switch precedence {
+	case PRECEDENCE_MERGE, PRECEDENCE_MOST_SPECIFIC, PRECEDENCE_PRIORITY, PRECEDENCE_FILE_ORDER:
+		return true
+	}
+	return false
+}
+
+// where a `remove` or `keep` rule comes from, as far as precedence is
+// concerned; ranks are compared lexicographically, and only ever get compared
+// between origins created with the same precedence
+type ruleOrigin struct {
+	rank []int
+}
+
+// nil in merge mode
+func (config *PruningConfig) originFor(pattern string, priority int) *ruleOrigin {
+	switch config.rulePrecedence {
+	case PRECEDENCE_MOST_SPECIFIC:
+		return &ruleOrigin{rank: patternSpecificity(pattern)}
+	case PRECEDENCE_PRIORITY:
+		return &ruleOrigin{rank: []int{priority}}
+	case PRECEDENCE_FILE_ORDER:
+		return &ruleOrigin{rank: []int{config.mergedFiles}}
+	default:
+		return nil
+	}
+}
+
+// exact segments are more specific than partial wildcards, which are more
+// specific than `*`, which is more specific than `**`; ties are broken by the
+// number of segments, and regular expressions are the least specific of all
+func patternSpecificity(pattern string) []int {
+	if isRegexPattern(pattern) {
+		return []int{-1, 0}
+	}
+
+	segments := strings.Split(pattern, ".")
+	score := 0
+	for _, segment := range segments {
+		switch {
+		case segment == "**":
+		case segment == "*":
+			score += 1
+		case isGlobSegment(segment):
+			score += 2
+		default:
+			score += 3
+		}
+	}
+
+	return []int{score, len(segments)}
+}
+
+// strictly stronger; nil origins never beat anything, nor get beaten
+func (origin *ruleOrigin) beats(other *ruleOrigin) bool {
+	if origin == nil || other == nil {
+		return false
+	}
+
+	for i := 0; i < len(origin.rank) && i < len(other.rank); i++ {
+		if origin.rank[i] != other.rank[i] {
+			return origin.rank[i] > other.rank[i]
+		}
+	}
+	return false
+}
+
+func strongestOrigin(origin, other *ruleOrigin) *ruleOrigin {
+	if origin == nil || other.beats(origin) {
+		return other
+	}
+	return origin
+}
+
+// `keep` rules win, unless the rule precedence says otherwise
+func removeWins(remove, keep bool, removeOrigin, keepOrigin *ruleOrigin) bool {
+	return remove && (!keep || removeOrigin.beats(keepOrigin))
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestPatternSpecificity(t *testing.T) {
+	// from the least to the most specific
+	patterns := []string{
+		"/^my_app\\..*$/",
+		"**",
+		"*",
+		"my_app.**",
+		"my_app.*",
+		"my_app.*_count",
+		"my_app.*.*",
+		"my_app.requests",
+		"my_app.http.*",
+		"my_app.http.requests",
+	}
+
+	for i := 0; i < len(patterns)-1; i++ {
+		less := &ruleOrigin{rank: patternSpecificity(patterns[i])}
+		more := &ruleOrigin{rank: patternSpecificity(patterns[i+1])}
+
+		if !more.beats(less) || less.beats(more) {
+			t.Errorf("Expected %v to be more specific than %v", patterns[i+1], patterns[i])
+		}
+	}
+}
+
+func TestRuleOriginBeats(t *testing.T) {
+	origin := &ruleOrigin{rank: []int{1}}
+
+	if origin.beats(&ruleOrigin{rank: []int{1}}) {
+		t.Errorf("Ties shouldn't beat each other")
+	}
+	if origin.beats(nil) || (*ruleOrigin)(nil).beats(origin) {
+		t.Errorf("Nil origins shouldn't beat nor be beaten")
+	}
+	if strongest := strongestOrigin(nil, origin); strongest != origin {
+		t.Errorf("Unexpected strongest origin: %#v", strongest)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// `when` clauses can also schedule rules with `not_before` and `expires`
+// timestamps; those get evaluated when merging pruning configs, and as soon as
+// any of them is reached, the pruning config gets rebuilt from the same
+// contents, without reloading anything
+
+const WHEN_DATE_FORMAT = "2006-01-02"
+
+// timestamps are either RFC 3339 timestamps, e.g. `2026-10-25T12:00:00Z`, or
+// dates, e.g. `2026-10-25`, meaning midnight UTC
+func parseWhenTimestamp(value string) (time.Time, error) {
+	if timestamp, err := time.Parse(time.RFC3339, value); err == nil {
+		return timestamp, nil
+	}
+	if timestamp, err := time.Parse(WHEN_DATE_FORMAT, value); err == nil {
+		return timestamp, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %v in when clause, should be e.g. 2026-10-25 or 2026-10-25T12:00:00Z", value)
+}
+
+// returns zero times for absent timestamps; the clause must have been
+// validated
+func (whenConfig *pruningConfigFileContentWhenConfig) schedule() (notBefore, expires time.Time) {
+	if whenConfig.Not_before != "" {
+		notBefore, _ = parseWhenTimestamp(whenConfig.Not_before)
+	}
+	if whenConfig.Expires != "" {
+		expires, _ = parseWhenTimestamp(whenConfig.Expires)
+	}
+	return
+}
+
+func (whenConfig *pruningConfigFileContentWhenConfig) validateSchedule() error {
+	for _, value := range []string{whenConfig.Not_before, whenConfig.Expires} {
+		if value == "" {
+			continue
+		}
+		if _, err := parseWhenTimestamp(value); err != nil {
+			return err
+		}
+	}
+
+	notBefore, expires := whenConfig.schedule()
+	if !notBefore.IsZero() && !expires.IsZero() && !notBefore.Before(expires) {
+		return errors.New("when clause expires before it starts")
+	}
+	return nil
+}
+
+// whether the clause's schedule has already expired at the given time
+func (whenConfig *pruningConfigFileContentWhenConfig) expiredAt(now time.Time) bool {
+	_, expires := whenConfig.schedule()
+	return !expires.IsZero() && !now.Before(expires)
+}
+
+// whether the rules at the given source are currently scheduled; also keeps
+// track of when the next rules are due to be activated or deactivated, and
+// logs the rules whose schedule has just changed
+func (config *PruningConfig) scheduleAllows(whenConfig *pruningConfigFileContentWhenConfig, source string) bool {
+	notBefore, expires := whenConfig.schedule()
+	if notBefore.IsZero() && expires.IsZero() {
+		return true
+	}
+
+	now := time.Now()
+	for _, transition := range []time.Time{notBefore, expires} {
+		if transition.After(now) && (config.nextTransition.IsZero() || transition.Before(config.nextTransition)) {
+			config.nextTransition = transition
+		}
+	}
+
+	justReached := func(transition time.Time) bool {
+		return !config.previousTransition.IsZero() && !transition.IsZero() &&
+			!transition.Before(config.previousTransition) && !transition.After(now)
+	}
+	switch {
+	case justReached(expires):
+		logInfo("Pruning rules at %v expired on %v", source, whenConfig.Expires)
+	case justReached(notBefore):
+		logInfo("Pruning rules at %v are now active, since %v", source, whenConfig.Not_before)
+	}
+
+	return (notBefore.IsZero() || !now.Before(notBefore)) && (expires.IsZero() || now.Before(expires))
+}
+
+// rebuilds the pruning config from the same contents once some scheduled
+// rules are due to be activated or deactivated, which also invalidates the
+// cached configs for resolved metrics
+func (config *PruningConfig) maybeApplySchedule() {
+	config.mutex.RLock()
+	due := config.scheduleDue()
+	config.mutex.RUnlock()
+	if !due {
+		return
+	}
+
+	// the rebuilt config gets swapped in under the same lock as reloads, so
+	// that we never overwrite a more recent config
+	config.mutex.Lock()
+	defer config.mutex.Unlock()
+	// some other request might have beaten us to it
+	if !config.scheduleDue() {
+		return
+	}
+
+	rebuilt := NewPruningConfig()
+	rebuilt.host = config.host
+	rebuilt.rulePrecedence = config.rulePrecedence
+	rebuilt.defaultGaugeAggregation = config.defaultGaugeAggregation
+	rebuilt.schedulable = true
+	rebuilt.previousTransition = config.nextTransition
+	for _, content := range config.contents {
+		// contents have already been validated
+		rebuilt.merge(content)
+	}
+
+	config.reset(rebuilt)
+}
+
+// must be called with the read lock held
+func (config *PruningConfig) scheduleDue() bool {
+	return config.schedulable && !config.nextTransition.IsZero() && !time.Now().Before(config.nextTransition)
+}
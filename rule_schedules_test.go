@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseWhenTimestamp(t *testing.T) {
+	for _, testCase := range []struct {
+		value    string
+		expected time.Time
+	}{
+		{"2026-10-25", time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC)},
+		{"2026-10-25T12:30:00Z", time.Date(2026, 10, 25, 12, 30, 0, 0, time.UTC)},
+		{"2026-10-25T12:30:00+02:00", time.Date(2026, 10, 25, 10, 30, 0, 0, time.UTC)},
+	} {
+		actual, err := parseWhenTimestamp(testCase.value)
+		if err != nil {
+			t.Errorf("Unexpected error for %v: %v", testCase.value, err)
+		} else if !actual.Equal(testCase.expected) {
+			t.Errorf("Unexpected timestamp for %v: %v", testCase.value, actual)
+		}
+	}
+
+	if _, err := parseWhenTimestamp("next week"); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestWhenClauseScheduleValidation(t *testing.T) {
+	whenConfig := &pruningConfigFileContentWhenConfig{Not_before: "2026-10-25", Expires: "2026-10-18"}
+	if err := whenConfig.validate(); err == nil || err.Error() != "when clause expires before it starts" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	whenConfig = &pruningConfigFileContentWhenConfig{Expires: "2026-13-18"}
+	if err := whenConfig.validate(); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+func TestRuleSchedules(t *testing.T) {
+	start := time.Now()
+	notBefore := start.Add(200 * time.Millisecond).Format(time.RFC3339Nano)
+	expires := start.Add(400 * time.Millisecond).Format(time.RFC3339Nano)
+
+	config := NewPruningConfig()
+	config.schedulable = true
+	if err := config.mergeWithContent([]byte(fmt.Sprintf("when:\n  expires: %v\nmetrics:\n  remove:\n    - my_app.debug\n", expires)), "debug.yml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.mergeWithContent([]byte(fmt.Sprintf(`tags:
+  remove:
+    - metrics:
+      - my_app.**
+      tags:
+      - instance-type
+      when:
+        not_before: %v
+`, notBefore)), "tags.yml"); err != nil {
+		t.Fatal(err)
+	}
+	// that's what happens when loading the service's config
+	live := NewPruningConfig()
+	live.Reset(config)
+
+	assertState := func(t *testing.T, expectedRemove bool, expectedRemoveTags map[string]bool) {
+		if remove := live.ConfigFor("my_app.debug").Remove; remove != expectedRemove {
+			t.Errorf("Unexpected remove: %v", remove)
+		}
+		if removeTags := live.ConfigFor("my_app.requests").RemoveTags; !reflect.DeepEqual(removeTags, expectedRemoveTags) {
+			t.Errorf("Unexpected removed tags: %v", removeTags)
+		}
+	}
+
+	t.Run("scheduled rules only apply once active, and until they expire", func(t *testing.T) {
+		assertState(t, true, map[string]bool{})
+	})
+
+	t.Run("rules get activated on schedule", func(t *testing.T) {
+		time.Sleep(time.Until(start.Add(250 * time.Millisecond)))
+
+		output := WithLogLevelAndCapturedLogging(INFO, func() {
+			assertState(t, true, map[string]bool{"instance-type": true})
+		})
+		CheckLogLines(t, output, "INFO: Pruning rules at tags.yml:3 are now active, since "+notBefore)
+	})
+
+	t.Run("rules get deactivated on schedule", func(t *testing.T) {
+		time.Sleep(time.Until(start.Add(450 * time.Millisecond)))
+
+		output := WithLogLevelAndCapturedLogging(INFO, func() {
+			assertState(t, false, map[string]bool{"instance-type": true})
+		})
+		CheckLogLines(t, output, "INFO: Pruning rules at debug.yml expired on "+expires)
+
+		if !live.nextTransition.IsZero() || live.contents != nil {
+			t.Error("Expected nothing left to schedule")
+		}
+	})
+}
+
+// meant to be run with -race, too
+func TestConcurrentScheduleRebuilds(t *testing.T) {
+	notBefore := time.Now().Add(100 * time.Millisecond).Format(time.RFC3339Nano)
+
+	config := NewPruningConfig()
+	config.schedulable = true
+	if err := config.mergeWithContent([]byte(fmt.Sprintf("when:\n  not_before: %v\nmetrics:\n  remove:\n    - my_app.debug\n", notBefore)), "debug.yml"); err != nil {
+		t.Fatal(err)
+	}
+	live := NewPruningConfig()
+	live.Reset(config)
+
+	output := WithLogLevelAndCapturedLogging(INFO, func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+					if live.ConfigFor("my_app.debug").Remove {
+						return
+					}
+				}
+				t.Error("Timed out waiting for the rules to be activated")
+			}()
+		}
+		wg.Wait()
+	})
+
+	// the config only got rebuilt once
+	CheckLogLines(t, output, "INFO: Pruning rules at debug.yml are now active, since "+notBefore)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// where a rule comes from, e.g. the 3rd item of the `metrics.remove` section
+// of /etc/k9/pruning_configs/payments.yml, at line 14
+type ruleSource struct {
+	file    string
+	line    int
+	section string
+	index   int
+	// the metric pattern the rule got merged for, if relevant
+	pattern string
+}
+
+func (source *ruleSource) withPattern(pattern string) *ruleSource {
+	sourceWithPattern := *source
+	sourceWithPattern.pattern = pattern
+	return &sourceWithPattern
+}
+
+func (source *ruleSource) String() string {
+	if source.file == "" {
+		return fmt.Sprintf("%v #%v", source.section, source.index)
+	}
+	return fmt.Sprintf("%v:%v", source.file, source.line)
+}
+
+// lists the rule sources, for logs
+func formatSources(sources []*ruleSource) string {
+	var buffer bytes.Buffer
+	for i, source := range sources {
+		if i != 0 {
+			buffer.WriteString(", ")
+		}
+		buffer.WriteString(source.String())
+	}
+	return buffer.String()
+}
+
+// for pruning configs that don't get interpolated, i.e. remote ones
+func parsePruningConfig(rawContent []byte, filename string) (*pruningConfigFileContent, error) {
+	document := &yaml.Node{}
+	if err := yaml.Unmarshal(rawContent, document); err != nil {
+		return nil, err
+	}
+
+	return decodePruningConfig(document, filename)
+}
+
+// also records the line of each rule; rules are indexed by the path to their
+// section, e.g. `tags.remove`
+func decodePruningConfig(document *yaml.Node, filename string) (*pruningConfigFileContent, error) {
+	content := &pruningConfigFileContent{
+		filename: filename,
+		lines:    make(map[string][]int),
+	}
+
+	if len(document.Content) == 0 {
+		// empty file
+		return content, nil
+	}
+
+	if err := decodeDocument(document, content); err != nil {
+		return nil, err
+	}
+	locateRules(document, "", content.lines)
+
+	return content, nil
+}
+
+func locateRules(node *yaml.Node, path string, lines map[string][]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			locateRules(child, path, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			childPath := node.Content[i].Value
+			if path != "" {
+				childPath = path + "." + childPath
+			}
+			locateRules(node.Content[i+1], childPath, lines)
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			lines[path] = append(lines[path], item.Line)
+		}
+	}
+}
+
+func (content *pruningConfigFileContent) sourceOf(section string, index int) *ruleSource {
+	source := &ruleSource{
+		file:    content.filename,
+		section: section,
+		index:   index,
+	}
+	if lines := content.lines[section]; index < len(lines) {
+		source.line = lines[index]
+	}
+	return source
+}
+
+func (content *pruningConfigFileContent) errorAt(section string, index int, err error) error {
+	return fmt.Errorf("%v: %v", content.sourceOf(section, index), err)
+}
+
+// reports rules defined several times for the same metric pattern, and
+// contradictory ones, along with which one wins, see toMetricPruningConfig;
+// only exactly identical patterns get compared, be they regular expressions
+// or not
+func (config *PruningConfig) reportConflicts(pattern string, existing, value *configValue, source *ruleSource) {
+	if existing == nil {
+		return
+	}
+
+	for _, existingSource := range existing.sources {
+		isMetricRule := source.section == "metrics.remove" || source.section == "metrics.keep"
+
+		switch {
+		case isMetricRule && existingSource.section == source.section:
+			config.reportConflict("Duplicate rule for %v at %v, already defined at %v", pattern, source, existingSource)
+		case value.remove && existingSource.section == "metrics.keep",
+			value.keep && existingSource.section == "metrics.remove":
+			removeOrigin, keepOrigin := value.removeOrigin, existing.keepOrigin
+			if value.keep {
+				removeOrigin, keepOrigin = existing.removeOrigin, value.keepOrigin
+			}
+			winner := "keep"
+			if removeOrigin.beats(keepOrigin) {
+				winner = "remove"
+			}
+			config.reportConflict("Contradictory rules for %v at %v and %v, the %v rule wins", pattern, existingSource, source, winner)
+		}
+	}
+}
+
+// conflicts get logged, and kept around for `k9 check`
+func (config *PruningConfig) reportConflict(format string, v ...interface{}) {
+	conflict := fmt.Sprintf(format, v...)
+	// already logged when first loading the config
+	if config.previousTransition.IsZero() {
+		logWarn("%v", conflict)
+	}
+	config.conflicts = append(config.conflicts, conflict)
+}
+
+// all the rules that apply to the given metric, for debugging purposes
+func (config *PruningConfig) sourcesFor(metric string) []*ruleSource {
+	config.mutex.RLock()
+	defer config.mutex.RUnlock()
+
+	return config.resolveValue(config.rename(metric)).sources
+}
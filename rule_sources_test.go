@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRuleSources(t *testing.T) {
+	config := NewPruningConfig()
+	var output string
+
+	output = WithCatpuredLogging(func() {
+		config.MergeWithFileOrGlob("test_fixtures/pruning_configs/sources/a.yml")
+	})
+	if output != "" {
+		t.Errorf("Unexpected output: %v", output)
+	}
+
+	t.Run("it reports duplicate and contradictory rules", func(t *testing.T) {
+		output = WithCatpuredLogging(func() {
+			config.MergeWithFileOrGlob("test_fixtures/pruning_configs/sources/b.yml")
+		})
+
+		if !CheckLogLines(t, output,
+			"WARN: Duplicate rule for my_app.debug.** at test_fixtures/pruning_configs/sources/b.yml:5, already defined at test_fixtures/pruning_configs/sources/a.yml:5",
+			"WARN: Contradictory rules for my_app.*.max at test_fixtures/pruning_configs/sources/a.yml:6 and test_fixtures/pruning_configs/sources/b.yml:7, the keep rule wins") {
+			t.Errorf("Unexpected output: %v", output)
+		}
+	})
+
+	t.Run("it records where each rule comes from", func(t *testing.T) {
+		for metric, expected := range map[string][]string{
+			"my_app.debug.foo": []string{
+				"test_fixtures/pruning_configs/sources/a.yml:10",
+				"test_fixtures/pruning_configs/sources/a.yml:5",
+				"test_fixtures/pruning_configs/sources/b.yml:5",
+			},
+			"my_app.http.max": []string{
+				"test_fixtures/pruning_configs/sources/a.yml:10",
+				"test_fixtures/pruning_configs/sources/a.yml:6",
+				"test_fixtures/pruning_configs/sources/b.yml:7",
+			},
+			"other_app.requests": []string{},
+		} {
+			sources := []string{}
+			for _, source := range config.sourcesFor(metric) {
+				sources = append(sources, source.String())
+			}
+
+			if !reflect.DeepEqual(expected, sources) {
+				t.Errorf("Unexpected sources for %v: %#v", metric, sources)
+			}
+		}
+
+		source := config.sourcesFor("my_app.debug.foo")[1]
+		if source.section != "metrics.remove" || source.index != 0 {
+			t.Errorf("Unexpected source: %#v", source)
+		}
+	})
+}
+
+func TestConflictsBetweenRegexRulesAndPrecedences(t *testing.T) {
+	config := NewPruningConfig()
+	config.rulePrecedence = PRECEDENCE_PRIORITY
+
+	output := WithCatpuredLogging(func() {
+		config.mergeWithContent([]byte("priority: 2\nmetrics:\n  remove:\n    - /^my_app\\./\n    - my_app.debug\n"), "a.yml")
+		config.mergeWithContent([]byte("metrics:\n  remove:\n    - /^my_app\\./\n  keep:\n    - my_app.debug\n"), "b.yml")
+	})
+
+	CheckLogLines(t, output,
+		"WARN: Duplicate rule for /^my_app\\./ at b.yml:3, already defined at a.yml:4",
+		"WARN: Contradictory rules for my_app.debug at a.yml:5 and b.yml:5, the remove rule wins")
+}
+
+func TestParseEmptyPruningConfig(t *testing.T) {
+	config := NewPruningConfig()
+
+	if err := config.mergeWithFile("test_fixtures/pruning_configs/empty.yml"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const SECRET_COMMAND_TIMEOUT = 10 * time.Second
+
+// the API and application keys, which can be given in plain text, read from
+// a file, or output by a command, e.g. a secrets manager's CLI; they get
+// loaded again on every reload
+func (content *configFileContent) secrets() (apiKey, applicationKey string, err error) {
+	apiKey, err = loadSecret("api_key", content.Api_key, content.Api_key_file, content.Api_key_command)
+	if err != nil {
+		return
+	}
+	applicationKey, err = loadSecret("application_key", content.Application_key,
+		content.Application_key_file, content.Application_key_command)
+	return
+}
+
+func loadSecret(name, value, file, command string) (string, error) {
+	if err := checkSecretSources(name, value, file, command); err != nil {
+		return "", err
+	}
+
+	var source string
+	var output []byte
+	var err error
+	switch {
+	case file != "":
+		source = name + "_file"
+		output, err = ioutil.ReadFile(file)
+	case command != "":
+		source = name + "_command"
+		output, err = runSecretCommand(command)
+	default:
+		return value, nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("unable to load %v: %v", source, err)
+	}
+	secret := strings.TrimSpace(string(output))
+	if secret == "" {
+		return "", fmt.Errorf("unable to load %v: empty secret", source)
+	}
+	return secret, nil
+}
+
+func checkSecretSources(name, value, file, command string) error {
+	sources := 0
+	for _, source := range []string{value, file, command} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("only one of %v, %v_file and %v_command can be set", name, name, name)
+	}
+	return nil
+}
+
+// the command's stderr goes to k9's, but never to the logs
+func runSecretCommand(command string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), SECRET_COMMAND_TIMEOUT)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
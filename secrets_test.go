@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSecret(t *testing.T) {
+	for _, testCase := range []struct {
+		name          string
+		value         string
+		file          string
+		command       string
+		expected      string
+		expectedError string
+	}{
+		{
+			name:     "in plain text",
+			value:    "9775a026f1ca7d1c6c5af9d94d9595a4",
+			expected: "9775a026f1ca7d1c6c5af9d94d9595a4",
+		},
+		{
+			name:     "from a file",
+			file:     "test_fixtures/secrets/api_key",
+			expected: "9775a026f1ca7d1c6c5af9d94d9595a4",
+		},
+		{
+			name:     "from a command",
+			command:  "echo '  9775a026f1ca7d1c6c5af9d94d9595a4'",
+			expected: "9775a026f1ca7d1c6c5af9d94d9595a4",
+		},
+		{
+			name: "not set",
+		},
+		{
+			name:          "from a missing file",
+			file:          "/i/dont/exist",
+			expectedError: "unable to load api_key_file: open /i/dont/exist: no such file or directory",
+		},
+		{
+			name:          "from a failing command",
+			command:       "exit 3",
+			expectedError: "unable to load api_key_command: exit status 3",
+		},
+		{
+			name:          "from a command with no output",
+			command:       "true",
+			expectedError: "unable to load api_key_command: empty secret",
+		},
+		{
+			name:          "from several sources",
+			value:         "9775a026f1ca7d1c6c5af9d94d9595a4",
+			command:       "echo 9775a026f1ca7d1c6c5af9d94d9595a4",
+			expectedError: "only one of api_key, api_key_file and api_key_command can be set",
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			actual, err := loadSecret("api_key", testCase.value, testCase.file, testCase.command)
+
+			if testCase.expectedError != "" {
+				if err == nil || err.Error() != testCase.expectedError {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != testCase.expected {
+				t.Errorf("Unexpected secret: %v", actual)
+			}
+		})
+	}
+}
+
+func TestConfigSecrets(t *testing.T) {
+	config := NewConfig("test_fixtures/configs/secrets.yml", "")
+
+	if config.ApiKey != "9775a026f1ca7d1c6c5af9d94d9595a4" || config.ApplicationKey != "87ce4a24b5553d2e482ea8a8500e71b8ad4554ff" {
+		t.Errorf("Unexpected config: %#v", config)
+	}
+
+	t.Run("secrets never get logged", func(t *testing.T) {
+		output := WithLogLevelAndCapturedLogging(DEBUG, func() {
+			logDebug("Keys: %v and %v", config.ApiKey, config.ApplicationKey)
+		})
+
+		CheckLogLines(t, output, "DEBUG: Keys: <redacted> and <redacted>")
+	})
+
+	t.Run("secrets get loaded again on reload", func(t *testing.T) {
+		dir, err := ioutil.TempDir("/tmp", "k9-test-secrets-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		writeFile := func(name, content string) {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		writeFile("api_key", "old_api_key\n")
+		writeFile("k9.yml", "api_key_file: "+filepath.Join(dir, "api_key")+"\n")
+
+		config := NewConfig(filepath.Join(dir, "k9.yml"), "")
+		if config.ApiKey != "old_api_key" {
+			t.Errorf("Unexpected API key: %v", config.ApiKey)
+		}
+
+		writeFile("api_key", "new_api_key\n")
+		WithCatpuredLogging(func() {
+			config.Reload()
+		})
+		if config.ApiKey != "new_api_key" {
+			t.Errorf("Unexpected API key: %v", config.ApiKey)
+		}
+
+		// and keeps the previous ones if they can't be loaded
+		os.Remove(filepath.Join(dir, "api_key"))
+		output := WithLogLevelAndCapturedLogging(INFO, func() {
+			config.Reload()
+		})
+		CheckLogLines(t, output, "INFO: Reloading configuration...", "ERROR: Reload failed, keeping the previous configuration: Unable to load the secrets for the config at "+
+			filepath.Join(dir, "k9.yml")+": unable to load api_key_file: open "+filepath.Join(dir, "api_key")+": no such file or directory")
+		if config.ApiKey != "new_api_key" {
+			t.Errorf("Unexpected API key: %v", config.ApiKey)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import "regexp"
+
+// conditions that can only be evaluated against actual series, e.g. to remove
+// series with a given tag; all the conditions need to be met for the series to
+// match
+type seriesCondition struct {
+	tags []*tagMatcher
+	// empty to match any type
+	types map[string]bool
+	// nil to match any device name
+	deviceName *regexp.Regexp
+}
+
+func (condition *seriesCondition) matches(metric map[string]interface{}, tags []string) bool {
+	if len(condition.types) != 0 && !condition.types[seriesType(metric)] {
+		return false
+	}
+	if condition.deviceName != nil {
+		deviceName, ok := metric["device_name"].(string)
+		if !ok || !condition.deviceName.MatchString(deviceName) {
+			return false
+		}
+	}
+	for _, matcher := range condition.tags {
+		if !matcher.matchesAny(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+func isValidMetricType(metricType string) bool {
+	switch metricType {
+	case "gauge", "rate", "count":
+		return true
+	}
+	return false
+}
+
+// series sent without a type are gauges
+func seriesType(metric map[string]interface{}) string {
+	if metricType, ok := metric["type"].(string); ok && metricType != "" {
+		return metricType
+	}
+	return "gauge"
+}
+
+// whether the given series matches any conditional remove rule
+func (config *MetricPruningConfig) RemovesSeries(metric map[string]interface{}) bool {
+	if len(config.removeConditions) == 0 {
+		return false
+	}
+
+	tags := seriesTags(metric)
+	for _, condition := range config.removeConditions {
+		if condition.matches(metric, tags) {
+			return true
+		}
+	}
+	return false
+}
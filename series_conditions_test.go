@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSeriesConditions(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/conditions.yml")
+
+	t.Run("it removes series based on their type, device name and tags", func(t *testing.T) {
+		for _, testCase := range []struct {
+			metric         string
+			fields         map[string]interface{}
+			expectedRemove bool
+		}{
+			// device names
+			{"system.disk.free", map[string]interface{}{"device_name": "/dev/loop3"}, true},
+			{"system.disk.free", map[string]interface{}{"device_name": "/dev/sda1"}, false},
+			{"system.disk.free", map[string]interface{}{"device_name": nil}, false},
+			{"system.io.r_s", map[string]interface{}{"device_name": "ram12"}, true},
+			{"system.io.r_s", map[string]interface{}{"device_name": "sda"}, false},
+			// types
+			{"my_app.requests", map[string]interface{}{"type": "rate"}, true},
+			{"my_app.requests", map[string]interface{}{"type": "count"}, false},
+			// types and tags; series without a type are gauges
+			{"my_app.queue.size", map[string]interface{}{"type": "gauge", "tags": []interface{}{"env:sandbox"}}, true},
+			{"my_app.queue.size", map[string]interface{}{"tags": []interface{}{"env:sandbox"}}, true},
+			{"my_app.queue.size", map[string]interface{}{"type": "count", "tags": []interface{}{"env:sandbox"}}, false},
+			{"my_app.queue.size", map[string]interface{}{"type": "gauge", "tags": []interface{}{"env:prod"}}, false},
+			// tag presence
+			{"my_app.jobs.count", map[string]interface{}{"tags": []interface{}{"debug"}}, true},
+			{"my_app.jobs.count", map[string]interface{}{"tags": []interface{}{"debug:true"}}, true},
+			{"my_app.jobs.count", map[string]interface{}{"tags": []interface{}{"env:prod"}}, false},
+		} {
+			metric := map[string]interface{}{"metric": testCase.metric}
+			for key, value := range testCase.fields {
+				metric[key] = value
+			}
+
+			if actual := config.ConfigFor(testCase.metric).RemovesSeries(metric); actual != testCase.expectedRemove {
+				t.Errorf("Unexpected decision for %#v: %v", metric, actual)
+			}
+		}
+	})
+
+	tagValuesConfig := NewPruningConfig()
+	tagValuesConfig.MergeWithFileOrGlob("test_fixtures/pruning_configs/tag_values.yml")
+
+	t.Run("it removes series based on their tag values", func(t *testing.T) {
+		pruningConfig := tagValuesConfig.ConfigFor("my_app.my_metric")
+		for tags, expected := range map[string]bool{
+			`["env:sandbox", "role:web"]`: true,
+			`["env:prod", "role:web"]`:    false,
+			`[]`:                          false,
+		} {
+			metric := parseJson(t, `{"metric": "my_app.my_metric", "tags": `+tags+`}`)
+			if actual := pruningConfig.RemovesSeries(metric); actual != expected {
+				t.Errorf("Unexpected result for tags %v: %v", tags, actual)
+			}
+		}
+
+		// all the conditions need to be met
+		pruningConfig = tagValuesConfig.ConfigFor("my_app.debug.my_metric")
+		for tags, expected := range map[string]bool{
+			`["debug:true", "env:production"]`: true,
+			`["debug", "env:prod"]`:            true,
+			`["env:prod"]`:                     false,
+			`["debug:true", "env:staging"]`:    false,
+		} {
+			metric := parseJson(t, `{"metric": "my_app.debug.my_metric", "tags": `+tags+`}`)
+			if actual := pruningConfig.RemovesSeries(metric); actual != expected {
+				t.Errorf("Unexpected result for tags %v: %v", tags, actual)
+			}
+		}
+
+		// and keep rules override conditional remove rules
+		pruningConfig = tagValuesConfig.ConfigFor("my_app.important")
+		if pruningConfig.RemovesSeries(parseJson(t, `{"metric": "my_app.important", "tags": ["env:sandbox"]}`)) {
+			t.Errorf("Unexpected pruning config: %#v", pruningConfig)
+		}
+	})
+
+	t.Run("it rejects unknown metric types", func(t *testing.T) {
+		AssertRejectsPruningConfig(t, "metrics:\n  remove_if:\n    - metrics:\n      - my_app.requests\n      type:\n      - histogram\n", 3)
+	})
+}
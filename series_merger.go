@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// how to combine the values of colliding series, see mergeCollidingSeries
+const (
+	AGGREGATION_SUM  = "sum"
+	AGGREGATION_AVG  = "avg"
+	AGGREGATION_MAX  = "max"
+	AGGREGATION_MIN  = "min"
+	AGGREGATION_LAST = "last"
+)
+
+const DEFAULT_GAUGE_AGGREGATION = AGGREGATION_AVG
+
+func isValidAggregation(aggregation string) bool {
+	switch aggregation {
+	case AGGREGATION_SUM, AGGREGATION_AVG, AGGREGATION_MAX, AGGREGATION_MIN, AGGREGATION_LAST:
+		return true
+	}
+	return false
+}
+
+// counts and rates are always summed, gauges are aggregated according to the
+// given aggregation
+func aggregationForType(metricType, gaugeAggregation string) string {
+	switch metricType {
+	case "count", "rate":
+		return AGGREGATION_SUM
+	default:
+		return gaugeAggregation
+	}
+}
+
+func aggregate(aggregation string, values []float64) float64 {
+	result := values[0]
+
+	for _, value := range values[1:] {
+		switch aggregation {
+		case AGGREGATION_SUM, AGGREGATION_AVG:
+			result += value
+		case AGGREGATION_MAX:
+			if value > result {
+				result = value
+			}
+		case AGGREGATION_MIN:
+			if value < result {
+				result = value
+			}
+		case AGGREGATION_LAST:
+			result = value
+		}
+	}
+
+	if aggregation == AGGREGATION_AVG {
+		result /= float64(len(values))
+	}
+
+	return result
+}
+
+// once tags or hosts have been removed, several series from the same payload
+// can end up with the same name and tags, in which case Datadog would only keep
+// one of them for any given timestamp; so we merge them according to their type
+func (transformer *DDTransformer) mergeCollidingSeries(series []map[string]interface{}) []map[string]interface{} {
+	groups := make(map[string][]map[string]interface{})
+	keys := []string{}
+	for _, metric := range series {
+		key := seriesKey(metric)
+		if _, present := groups[key]; !present {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], metric)
+	}
+
+	if len(keys) == len(series) {
+		// no collision, nothing to do
+		return series
+	}
+
+	mergedSeries := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		group := groups[key]
+
+		if len(group) > 1 {
+			if merged, err := transformer.mergeSeries(group); err == nil {
+				group = []map[string]interface{}{merged}
+			} else {
+				logWarn("Unable to merge colliding series %#v: %v", group, err)
+			}
+		}
+
+		mergedSeries = append(mergedSeries, group...)
+	}
+
+	return mergedSeries
+}
+
+// merges the given series, which are assumed to share the same key, into the
+// first one
+func (transformer *DDTransformer) mergeSeries(group []map[string]interface{}) (map[string]interface{}, error) {
+	aggregator := newPointsAggregator(transformer.aggregationFor(group[0]))
+
+	for _, metric := range group {
+		points, err := parsePoints(metric["points"])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, point := range points {
+			aggregator.add(point[0], point[1])
+		}
+	}
+
+	merged := make(map[string]interface{}, len(group[0]))
+	for key, value := range group[0] {
+		merged[key] = value
+	}
+	merged["points"] = aggregator.points()
+
+	return merged, nil
+}
+
+// accumulates values by timestamp, then aggregates them
+type pointsAggregator struct {
+	aggregation       string
+	valuesByTimestamp map[float64][]float64
+	// to output points in the order they were first received
+	timestamps []float64
+}
+
+func newPointsAggregator(aggregation string) *pointsAggregator {
+	return &pointsAggregator{
+		aggregation:       aggregation,
+		valuesByTimestamp: make(map[float64][]float64),
+	}
+}
+
+func (aggregator *pointsAggregator) add(timestamp, value float64) {
+	if _, present := aggregator.valuesByTimestamp[timestamp]; !present {
+		aggregator.timestamps = append(aggregator.timestamps, timestamp)
+	}
+	aggregator.valuesByTimestamp[timestamp] = append(aggregator.valuesByTimestamp[timestamp], value)
+}
+
+func (aggregator *pointsAggregator) points() []interface{} {
+	points := make([]interface{}, 0, len(aggregator.timestamps))
+	for _, timestamp := range aggregator.timestamps {
+		points = append(points, []interface{}{timestamp, aggregate(aggregator.aggregation, aggregator.valuesByTimestamp[timestamp])})
+	}
+	return points
+}
+
+// removes and returns the points up to the given timestamp, along with the
+// latest one's timestamp
+func (aggregator *pointsAggregator) takeUntil(limit float64) ([]interface{}, float64) {
+	points := []interface{}{}
+	latest := math.Inf(-1)
+	pendingTimestamps := []float64{}
+
+	for _, timestamp := range aggregator.timestamps {
+		if timestamp > limit {
+			pendingTimestamps = append(pendingTimestamps, timestamp)
+			continue
+		}
+
+		points = append(points, []interface{}{timestamp, aggregate(aggregator.aggregation, aggregator.valuesByTimestamp[timestamp])})
+		latest = math.Max(latest, timestamp)
+		delete(aggregator.valuesByTimestamp, timestamp)
+	}
+	aggregator.timestamps = pendingTimestamps
+
+	return points, latest
+}
+
+func (aggregator *pointsAggregator) isEmpty() bool {
+	return len(aggregator.timestamps) == 0
+}
+
+func (transformer *DDTransformer) aggregationFor(metric map[string]interface{}) string {
+	name, _ := metric["metric"].(string)
+	metricType, _ := metric["type"].(string)
+
+	gaugeAggregation := transformer.config.ConfigForRenamed(name).GaugeAggregation
+	if gaugeAggregation == "" {
+		gaugeAggregation = transformer.config.DefaultGaugeAggregation()
+	}
+
+	return aggregationForType(metricType, gaugeAggregation)
+}
+
+func parsePoints(rawPoints interface{}) ([][2]float64, error) {
+	list, ok := rawPoints.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected points: %#v", rawPoints)
+	}
+
+	points := make([][2]float64, 0, len(list))
+	for _, rawPoint := range list {
+		point, ok := rawPoint.([]interface{})
+		if !ok || len(point) != 2 {
+			return nil, fmt.Errorf("unexpected point: %#v", rawPoint)
+		}
+
+		timestamp, timestampOk := point[0].(float64)
+		value, valueOk := point[1].(float64)
+		if !timestampOk || !valueOk {
+			return nil, fmt.Errorf("unexpected point: %#v", rawPoint)
+		}
+
+		points = append(points, [2]float64{timestamp, value})
+	}
+
+	return points, nil
+}
+
+// two series with the same key are considered to be the same series by Datadog
+func seriesKey(metric map[string]interface{}) string {
+	parts := []string{
+		fmt.Sprintf("%v", metric["metric"]),
+		fmt.Sprintf("%v", metric["host"]),
+		fmt.Sprintf("%v", metric["device_name"]),
+		fmt.Sprintf("%v", metric["type"]),
+	}
+
+	tags := seriesTags(metric)
+	sort.Strings(tags)
+
+	return strings.Join(append(parts, tags...), "\x00")
+}
+
+func seriesTags(metric map[string]interface{}) []string {
+	switch tags := metric["tags"].(type) {
+	case []string:
+		return append([]string{}, tags...)
+	case []interface{}:
+		result := make([]string, 0, len(tags))
+		for _, rawTag := range tags {
+			if tag, ok := rawTag.(string); ok {
+				result = append(result, tag)
+			}
+		}
+		return result
+	default:
+		return []string{}
+	}
+}
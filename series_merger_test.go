@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	values := []float64{3, 1, 8, 4}
+
+	for aggregation, expected := range map[string]float64{
+		AGGREGATION_SUM:  16,
+		AGGREGATION_AVG:  4,
+		AGGREGATION_MAX:  8,
+		AGGREGATION_MIN:  1,
+		AGGREGATION_LAST: 4,
+	} {
+		if actual := aggregate(aggregation, values); actual != expected {
+			t.Errorf("Unexpected result for %v: %v", aggregation, actual)
+		}
+	}
+}
+
+func TestMergeCollidingSeries(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/aggregations.yml")
+	transformer := NewTransformer(config, nil)
+
+	transform := func(t *testing.T, jsonInput string) []interface{} {
+		jsonDocument := parseJson(t, jsonInput)
+		transformer.transformSeriesRequestJson(jsonDocument)
+		return parseJson(t, jsonEncode(t, jsonDocument))["series"].([]interface{})
+	}
+
+	t.Run("it sums up counts and rates", func(t *testing.T) {
+		series := transform(t, `{"series": [
+			{"metric": "my_app.requests", "type": "count", "host": "a", "tags": ["instance:1", "env:prod"], "points": [[10, 1], [20, 2]]},
+			{"metric": "my_app.requests", "type": "count", "host": "b", "tags": ["env:prod", "instance:2"], "points": [[10, 3]]},
+			{"metric": "my_app.hits", "type": "rate", "host": "a", "tags": ["instance:1"], "points": [[10, 0.5]]},
+			{"metric": "my_app.hits", "type": "rate", "host": "a", "tags": ["instance:2"], "points": [[10, 1.5]]}
+		]}`)
+
+		expected := []interface{}{
+			map[string]interface{}{"metric": "my_app.requests", "type": "count", "tags": []interface{}{"env:prod"}, "points": []interface{}{[]interface{}{10.0, 4.0}, []interface{}{20.0, 2.0}}},
+			map[string]interface{}{"metric": "my_app.hits", "type": "rate", "points": []interface{}{[]interface{}{10.0, 2.0}}},
+		}
+		if !reflect.DeepEqual(expected, series) {
+			t.Errorf("Unexpected series: %#v", series)
+		}
+	})
+
+	t.Run("it aggregates gauges according to the most specific rule", func(t *testing.T) {
+		series := transform(t, `{"series": [
+			{"metric": "my_app.queue_size", "type": "gauge", "host": "a", "points": [[10, 1]]},
+			{"metric": "my_app.queue_size", "type": "gauge", "host": "b", "points": [[10, 5]]},
+			{"metric": "my_app.workers.busy", "type": "gauge", "host": "a", "points": [[10, 1]]},
+			{"metric": "my_app.workers.busy", "type": "gauge", "host": "b", "points": [[10, 5]]},
+			{"metric": "my_app.workers.latency", "type": "gauge", "host": "a", "points": [[10, 1]]},
+			{"metric": "my_app.workers.latency", "type": "gauge", "host": "b", "points": [[10, 5]]}
+		]}`)
+
+		expected := []interface{}{
+			map[string]interface{}{"metric": "my_app.queue_size", "type": "gauge", "points": []interface{}{[]interface{}{10.0, 5.0}}},
+			map[string]interface{}{"metric": "my_app.workers.busy", "type": "gauge", "points": []interface{}{[]interface{}{10.0, 6.0}}},
+			map[string]interface{}{"metric": "my_app.workers.latency", "type": "gauge", "points": []interface{}{[]interface{}{10.0, 1.0}}},
+		}
+		if !reflect.DeepEqual(expected, series) {
+			t.Errorf("Unexpected series: %#v", series)
+		}
+	})
+
+	t.Run("it falls back to the default aggregation for gauges", func(t *testing.T) {
+		series := transform(t, `{"series": [
+			{"metric": "other_app.queue_size", "type": "gauge", "tags": ["env:prod"], "points": [[10, 1]]},
+			{"metric": "other_app.queue_size", "type": "gauge", "tags": ["env:prod"], "points": [[10, 5]]}
+		]}`)
+
+		expected := []interface{}{
+			map[string]interface{}{"metric": "other_app.queue_size", "type": "gauge", "tags": []interface{}{"env:prod"}, "points": []interface{}{[]interface{}{10.0, 3.0}}},
+		}
+		if !reflect.DeepEqual(expected, series) {
+			t.Errorf("Unexpected series: %#v", series)
+		}
+	})
+
+	t.Run("it leaves series that don't collide alone", func(t *testing.T) {
+		series := transform(t, `{"series": [
+			{"metric": "my_app.queue_size", "type": "gauge", "host": "a", "tags": ["env:prod"], "points": [[10, 1]]},
+			{"metric": "my_app.queue_size", "type": "gauge", "host": "b", "tags": ["env:staging"], "points": [[10, 5]]},
+			{"metric": "other_app.queue_size", "type": "gauge", "host": "a", "points": [[10, 1]]},
+			{"metric": "other_app.queue_size", "type": "gauge", "host": "b", "points": [[10, 5]]}
+		]}`)
+
+		if len(series) != 4 {
+			t.Errorf("Unexpected series: %#v", series)
+		}
+	})
+
+	t.Run("it leaves colliding series alone if their points can't be parsed", func(t *testing.T) {
+		var series []interface{}
+		output := WithCatpuredLogging(func() {
+			series = transform(t, `{"series": [
+				{"metric": "my_app.queue_size", "type": "gauge", "host": "a", "points": [[10, null]]},
+				{"metric": "my_app.queue_size", "type": "gauge", "host": "b", "points": [[10, 5]]}
+			]}`)
+		})
+
+		if len(series) != 2 {
+			t.Errorf("Unexpected series: %#v", series)
+		}
+		if output == "" {
+			t.Errorf("Expected a warning")
+		}
+	})
+}
+
+func TestInvalidAggregation(t *testing.T) {
+	config := NewPruningConfig()
+
+	if err := config.mergeWithFile("test_fixtures/pruning_configs/invalid_aggregation.yml"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// matches tags against patterns of the form `name` or `name:value`, where the
+// name can be a glob pattern, and the value either a glob pattern or a regular
+// expression wrapped in slashes, e.g. `version:/^[0-9a-f]{40}$/`; literal values
+// wrapped in slashes need their first slash escaped, e.g. `path:\/api/`
+type tagMatcher struct {
+	// as found in the config
+	pattern string
+	name    string
+	// nil to match any value
+	value *regexp.Regexp
+}
+
+func parseTagMatcher(pattern string) (*tagMatcher, error) {
+	name, value, hasValue := splitTag(pattern)
+
+	if _, err := filepath.Match(name, ""); err != nil {
+		return nil, fmt.Errorf("invalid tag pattern %v: %v", pattern, err)
+	}
+	matcher := &tagMatcher{pattern: pattern, name: name}
+
+	if hasValue {
+		var err error
+		if isRegexPattern(value) {
+			matcher.value, err = compileRegexPattern(value)
+		} else {
+			matcher.value, err = compileGlob(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag pattern %v: %v", pattern, err)
+		}
+	}
+
+	return matcher, nil
+}
+
+func (matcher *tagMatcher) matchesName(name string) bool {
+	matched, _ := filepath.Match(matcher.name, name)
+	return matched
+}
+
+func (matcher *tagMatcher) matches(name, value string, hasValue bool) bool {
+	if !matcher.matchesName(name) {
+		return false
+	}
+	return matcher.value == nil || (hasValue && matcher.value.MatchString(value))
+}
+
+func (matcher *tagMatcher) matchesAny(tags []string) bool {
+	for _, tag := range tags {
+		if matcher.matches(splitTag(tag)) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitTag(tag string) (name, value string, hasValue bool) {
+	splitTag := strings.SplitN(tag, ":", 2)
+	if len(splitTag) == 2 {
+		return splitTag[0], splitTag[1], true
+	}
+	return splitTag[0], "", false
+}
+
+// unlike filepath.Match, wildcards in tag values should also match slashes,
+// hence this conversion to a regular expression
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	var buffer bytes.Buffer
+	buffer.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch char := glob[i]; char {
+		case '*':
+			buffer.WriteString(".*")
+		case '?':
+			buffer.WriteString(".")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				buffer.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			} else {
+				buffer.WriteString(`\\`)
+			}
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				return nil, filepath.ErrBadPattern
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buffer.WriteString("[" + class + "]")
+			i += end
+		default:
+			buffer.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+
+	buffer.WriteString("$")
+	return regexp.Compile(buffer.String())
+}
+
+func matchesAnyPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCompileGlob(t *testing.T) {
+	for glob, expectations := range map[string]map[string]bool{
+		"/users/*":    {"/users/123": true, "/users/123/posts/456": true, "/users": false, "/posts/123": false},
+		"v?.[0-9]*":   {"v1.2.3": true, "v12.2": false, "v1.x": false},
+		"[!a-c]-\\*":  {"d-*": true, "a-*": false, "d-x": false},
+		"exact.value": {"exact.value": true, "exactXvalue": false},
+	} {
+		regex, err := compileGlob(glob)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for value, expected := range expectations {
+			if actual := regex.MatchString(value); actual != expected {
+				t.Errorf("Unexpected result for %v matching %v: %v", value, glob, actual)
+			}
+		}
+	}
+
+	if _, err := compileGlob("[abc"); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestParseTagMatcher(t *testing.T) {
+	for pattern, expectations := range map[string]map[string]bool{
+		// values wrapped in slashes are regular expressions, matched anywhere
+		"path:/api/": {"path:/api/": true, "path:/v1/rapid": true, "path:/v1/": false},
+		// unless their first slash is escaped
+		"path:\\/api/": {"path:/api/": true, "path:/v1/rapid": false, "path:/api/v1": false},
+		"path:/api/*":  {"path:/api/v1": true, "path:/v1/api/": false},
+	} {
+		matcher, err := parseTagMatcher(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for tag, expected := range expectations {
+			if actual := matcher.matches(splitTag(tag)); actual != expected {
+				t.Errorf("Unexpected result for %v matching %v: %v", tag, pattern, actual)
+			}
+		}
+	}
+}
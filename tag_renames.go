@@ -0,0 +1,40 @@
+package main
+
+// renames the given tag's name if needed
+func (config *MetricPruningConfig) RenameTag(tag string) string {
+	if len(config.RenameTags) == 0 {
+		return tag
+	}
+
+	name, value, hasValue := splitTag(tag)
+	newName, present := config.RenameTags[name]
+	if !present {
+		return tag
+	}
+	if hasValue {
+		return newName + ":" + value
+	}
+	return newName
+}
+
+// adds the static tags to the given tags; static tags replace any existing tag
+// with the same name
+func (config *MetricPruningConfig) AddStaticTags(tags []string) []string {
+	if len(config.AddTags) == 0 {
+		return tags
+	}
+
+	staticNames := make(map[string]bool, len(config.AddTags))
+	for _, staticTag := range config.AddTags {
+		name, _, _ := splitTag(staticTag)
+		staticNames[name] = true
+	}
+
+	newTags := make([]string, 0, len(tags)+len(config.AddTags))
+	for _, tag := range tags {
+		if name, _, _ := splitTag(tag); !staticNames[name] {
+			newTags = append(newTags, tag)
+		}
+	}
+	return append(newTags, config.AddTags...)
+}
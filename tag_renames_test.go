@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTagRenamesAndStaticTags(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/tag_renames.yml")
+
+	t.Run("it renames tags", func(t *testing.T) {
+		pruningConfig := config.ConfigFor("my_app.payments.charges")
+		expected := &MetricPruningConfig{
+			RemoveTags: map[string]bool{"instance": true},
+			RenameTags: map[string]string{"es_host": "db_host"},
+			AddTags:    []string{"cost_center:42", "team:payments"},
+		}
+		if !reflect.DeepEqual(expected, pruningConfig) {
+			t.Errorf("Unexpected pruning config: %#v", pruningConfig)
+		}
+
+		for tag, expected := range map[string]string{
+			"es_host:db-1": "db_host:db-1",
+			"es_host":      "db_host",
+			"env:prod":     "env:prod",
+		} {
+			if actual := pruningConfig.RenameTag(tag); actual != expected {
+				t.Errorf("Unexpected rename for %v: %v", tag, actual)
+			}
+		}
+
+		// the most specific renames win
+		if renameTags := config.ConfigFor("my_app.legacy.requests").RenameTags; !reflect.DeepEqual(map[string]string{"es_host": "legacy_db_host"}, renameTags) {
+			t.Errorf("Unexpected renames: %#v", renameTags)
+		}
+	})
+
+	t.Run("it adds static tags", func(t *testing.T) {
+		// static tags replace existing tags with the same name
+		tags := config.ConfigFor("my_app.requests").AddStaticTags([]string{"team:search", "env:prod"})
+		if !reflect.DeepEqual([]string{"env:prod", "team:platform"}, tags) {
+			t.Errorf("Unexpected tags: %#v", tags)
+		}
+
+		if pruningConfig := config.ConfigFor("other_app.requests"); pruningConfig.AddTags != nil {
+			t.Errorf("Unexpected static tags: %#v", pruningConfig.AddTags)
+		}
+	})
+
+	t.Run("it merges series that collide once renamed", func(t *testing.T) {
+		transformer := NewTransformer(config, nil)
+
+		jsonDocument := parseJson(t, `{"series": [
+			{"metric": "my_app.payments.charges", "type": "count", "tags": ["es_host:db-1", "instance:1", "team:search"], "points": [[10, 1]]},
+			{"metric": "my_app.payments.charges", "type": "count", "tags": ["db_host:db-1", "instance:2"], "points": [[10, 2]]},
+			{"metric": "other_app.requests", "type": "count", "tags": ["es_host:db-1", "instance:1"], "points": [[10, 1]]}
+		]}`)
+		transformer.transformSeriesRequestJson(jsonDocument)
+
+		expectedOutput := parseJson(t, `{"series": [
+			{"metric": "my_app.payments.charges", "type": "count", "tags": ["db_host:db-1", "cost_center:42", "team:payments"], "points": [[10, 3]]},
+			{"metric": "other_app.requests", "type": "count", "tags": ["db_host:db-1", "instance:1"], "points": [[10, 1]]}
+		]}`)
+		if actualOutput := parseJson(t, jsonEncode(t, jsonDocument)); !reflect.DeepEqual(expectedOutput, actualOutput) {
+			t.Errorf("Unexpected body:\n%v\nVS expected:\n%v", jsonEncode(t, actualOutput), jsonEncode(t, expectedOutput))
+		}
+	})
+
+	t.Run("it rejects renames and static tags using patterns", func(t *testing.T) {
+		AssertRejectsPruningConfig(t, "tags:\n  rename:\n    - metrics:\n      - '**'\n      from: es_*\n      to: db_host\n", 3)
+		AssertRejectsPruningConfig(t, "tags:\n  rename:\n    - metrics:\n      - '**'\n      from: es_host\n      to: db_*\n", 3)
+		AssertRejectsPruningConfig(t, "tags:\n  add:\n    - metrics:\n      - '**'\n      tags:\n      - team*:payments\n", 3)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+)
+
+// rewrites the values of matching tags, either by replacing matches of a
+// regular expression, or by truncating them
+type tagRewrite struct {
+	// can be a glob pattern
+	name        string
+	regex       *regexp.Regexp
+	replacement string
+	truncate    int
+}
+
+func (rewrite *tagRewrite) apply(tag string) string {
+	name, value, hasValue := splitTag(tag)
+	if !hasValue {
+		return tag
+	}
+	if matched, _ := filepath.Match(rewrite.name, name); !matched {
+		return tag
+	}
+
+	if rewrite.regex != nil {
+		value = rewrite.regex.ReplaceAllString(value, rewrite.replacement)
+	}
+	// truncating by runes, not to send invalid UTF-8
+	if runes := []rune(value); rewrite.truncate > 0 && len(runes) > rewrite.truncate {
+		value = string(runes[:rewrite.truncate])
+	}
+
+	return name + ":" + value
+}
+
+// applies all the matching rewrite rules, in order, to the given tag
+func (config *MetricPruningConfig) RewriteTag(tag string) string {
+	for _, rewrite := range config.tagRewrites {
+		tag = rewrite.apply(tag)
+	}
+	return tag
+}
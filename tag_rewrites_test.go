@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTagRewrites(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/rewrite.yml")
+
+	t.Run("it rewrites tag values", func(t *testing.T) {
+		pruningConfig := config.ConfigFor("my_app.http.requests")
+		for tag, expected := range map[string]string{
+			"version:87003923341fc1e43469a50bb2e5b6b141210d40": "version:8700392",
+			"version:1.2":                      "version:1.2",
+			"version:héllo-wörld":              "version:héllo-w",
+			"version:日本語のバージョン":                "version:日本語のバージ",
+			"path:/users/123/posts/456":        "path:/users/:id/posts/:id",
+			"path:/health":                     "path:/health",
+			"pod_name:my-app-7d4b9c8f6d-x2k9p": "pod_name:my-app",
+			"pod:my-app":                       "pod:my-app",
+			"region:us-east-1":                 "region:us_x",
+			"version":                          "version",
+			"env:prod":                         "env:prod",
+		} {
+			if actual := pruningConfig.RewriteTag(tag); actual != expected {
+				t.Errorf("Unexpected rewrite for %v: %v", tag, actual)
+			}
+		}
+
+		// rewrites only apply to matching metrics
+		pruningConfig = config.ConfigFor("my_app.requests")
+		if actual := pruningConfig.RewriteTag("path:/users/123"); actual != "path:/users/123" {
+			t.Errorf("Unexpected rewrite: %v", actual)
+		}
+	})
+
+	t.Run("it merges series that collide once rewritten", func(t *testing.T) {
+		transformer := NewTransformer(config, nil)
+
+		jsonDocument := parseJson(t, `{"series": [
+			{"metric": "my_app.http.requests", "type": "count", "tags": ["version:87003923341fc1e43469a50bb2e5b6b141210d40", "path:/users/123"], "points": [[10, 1]]},
+			{"metric": "my_app.http.requests", "type": "count", "tags": ["version:87003923341fc1e43469a50bb2e5b6b141210d40", "path:/users/456"], "points": [[10, 2]]},
+			{"metric": "my_app.http.requests", "type": "count", "tags": ["version:8700392", "path:/users/456"], "points": [[10, 2]]}
+		]}`)
+		transformer.transformSeriesRequestJson(jsonDocument)
+
+		// removal rules apply to the tags as sent by the agent
+		expectedOutput := parseJson(t, `{"series": [
+			{"metric": "my_app.http.requests", "type": "count", "tags": ["version:8700392", "path:/users/:id"], "points": [[10, 3]]},
+			{"metric": "my_app.http.requests", "type": "count", "tags": ["path:/users/:id"], "points": [[10, 2]]}
+		]}`)
+		if actualOutput := parseJson(t, jsonEncode(t, jsonDocument)); !reflect.DeepEqual(expectedOutput, actualOutput) {
+			t.Errorf("Unexpected body:\n%v\nVS expected:\n%v", jsonEncode(t, actualOutput), jsonEncode(t, expectedOutput))
+		}
+	})
+
+	t.Run("it rejects invalid rewrites", func(t *testing.T) {
+		AssertRejectsPruningConfig(t, "rewrite:\n  - metrics:\n    - my_app.**\n    tag: version\n", 2)
+		AssertRejectsPruningConfig(t, "rewrite:\n  - metrics:\n    - my_app.**\n    tag: version\n    truncate: -1\n", 2)
+		AssertRejectsPruningConfig(t, "rewrite:\n  - metrics:\n    - my_app.**\n    tag: version\n    pattern: '[0-9'\n", 2)
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// tag rules that can only be resolved against actual tags, i.e. tag name
+// patterns and tag value rules; we cache what we can for each tag name we come
+// across
+type tagRules struct {
+	removeTags     map[string]bool
+	keepTags       map[string]bool
+	removePatterns []string
+	keepPatterns   []string
+	removeValues   []*tagMatcher
+	keepValues     []*tagMatcher
+	// if not empty, tags not matching any of these get removed
+	onlyPatterns []string
+	// the strongest rule for each tag name, pattern or value pattern above, nil
+	// in merge mode
+	removeOrigins map[string]*ruleOrigin
+	keepOrigins   map[string]*ruleOrigin
+	onlyOrigin    *ruleOrigin
+
+	mutex    sync.RWMutex
+	resolved map[string]*tagNameDecision
+}
+
+type tagNameDecision struct {
+	remove       bool
+	keep         bool
+	removeOrigin *ruleOrigin
+	keepOrigin   *ruleOrigin
+	// whether any value rule applies to this tag name
+	hasValueRules bool
+}
+
+func (rules *tagRules) removes(tag string) bool {
+	name, value, hasValue := splitTag(tag)
+	decision := rules.resolveName(name)
+
+	remove, keep := decision.remove, decision.keep
+	removeOrigin, keepOrigin := decision.removeOrigin, decision.keepOrigin
+	if decision.hasValueRules && hasValue {
+		for _, matcher := range rules.removeValues {
+			if matcher.matches(name, value, true) {
+				remove = true
+				removeOrigin = strongestOrigin(removeOrigin, rules.removeOrigins[matcher.pattern])
+			}
+		}
+		for _, matcher := range rules.keepValues {
+			if matcher.matches(name, value, true) {
+				keep = true
+				keepOrigin = strongestOrigin(keepOrigin, rules.keepOrigins[matcher.pattern])
+			}
+		}
+	}
+
+	return removeWins(remove, keep, removeOrigin, keepOrigin)
+}
+
+func (rules *tagRules) resolveName(name string) *tagNameDecision {
+	rules.mutex.RLock()
+	decision := rules.resolved[name]
+	rules.mutex.RUnlock()
+
+	if decision == nil {
+		decision = &tagNameDecision{}
+		if rules.removeTags[name] {
+			decision.addRemove(rules.removeOrigins[name])
+		}
+		for _, pattern := range rules.removePatterns {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				decision.addRemove(rules.removeOrigins[pattern])
+			}
+		}
+		if len(rules.onlyPatterns) != 0 && !matchesAnyPattern(rules.onlyPatterns, name) {
+			decision.addRemove(rules.onlyOrigin)
+		}
+		if rules.keepTags[name] {
+			decision.addKeep(rules.keepOrigins[name])
+		}
+		for _, pattern := range rules.keepPatterns {
+			if matched, _ := filepath.Match(pattern, name); matched {
+				decision.addKeep(rules.keepOrigins[pattern])
+			}
+		}
+		for _, matcher := range append(append([]*tagMatcher{}, rules.removeValues...), rules.keepValues...) {
+			if matcher.matchesName(name) {
+				decision.hasValueRules = true
+				break
+			}
+		}
+
+		rules.mutex.Lock()
+		rules.resolved[name] = decision
+		rules.mutex.Unlock()
+	}
+
+	return decision
+}
+
+// regardless of tag values
+func (decision *tagNameDecision) removes() bool {
+	return removeWins(decision.remove, decision.keep, decision.removeOrigin, decision.keepOrigin)
+}
+
+func (decision *tagNameDecision) addRemove(origin *ruleOrigin) {
+	decision.remove = true
+	decision.removeOrigin = strongestOrigin(decision.removeOrigin, origin)
+}
+
+func (decision *tagNameDecision) addKeep(origin *ruleOrigin) {
+	decision.keep = true
+	decision.keepOrigin = strongestOrigin(decision.keepOrigin, origin)
+}
+
+// whether the given series' host should be removed, taking rules on host values
+// into account, e.g. `host:/^tmp-/`
+func (config *MetricPruningConfig) RemovesHost(metric map[string]interface{}) bool {
+	if host, ok := metric["host"].(string); ok && config.hostValueRules {
+		return config.tagRules.removes("host:" + host)
+	}
+	return config.RemoveHost
+}
+
+// whether the given tag, of the form `name` or `name:value`, should be removed
+func (config *MetricPruningConfig) RemovesTag(tag string) bool {
+	if config.tagRules == nil {
+		name, _, _ := splitTag(tag)
+		return config.RemoveTags[name]
+	}
+
+	return config.tagRules.removes(tag)
+}
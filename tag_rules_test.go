@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTagValueRules(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/tag_values.yml")
+
+	t.Run("it removes tags based on their values", func(t *testing.T) {
+		pruningConfig := config.ConfigFor("my_app.my_metric")
+		for tag, expected := range map[string]bool{
+			"version:87003923341fc1e43469a50bb2e5b6b141210d40": true,
+			"version:1.2.3":        false,
+			"status:ok":            true,
+			"status:error":         false,
+			"status":               true,
+			"path:/users/123":      true,
+			"path:/posts/123":      false,
+			"aws_region:ignore_me": true,
+			"aws_region:us-east-1": false,
+			"env:prod":             false,
+		} {
+			if actual := pruningConfig.RemovesTag(tag); actual != expected {
+				t.Errorf("Unexpected result for tag %v: %v", tag, actual)
+			}
+		}
+	})
+
+	t.Run("it removes hosts based on their values", func(t *testing.T) {
+		pruningConfig := config.ConfigFor("my_app.my_metric")
+		if pruningConfig.RemoveHost || !pruningConfig.KeepHostTags {
+			t.Errorf("Unexpected pruning config: %#v", pruningConfig)
+		}
+		for host, expected := range map[string]bool{
+			"tmp-1234": true,
+			"web-1":    false,
+		} {
+			if actual := pruningConfig.RemovesHost(map[string]interface{}{"host": host}); actual != expected {
+				t.Errorf("Unexpected result for host %v: %v", host, actual)
+			}
+		}
+	})
+
+	t.Run("it removes tags and series from requests", func(t *testing.T) {
+		transformer := NewTransformer(config, nil)
+
+		jsonDocument := parseJson(t, `{"series": [
+			{"metric": "my_app.requests", "tags": ["version:87003923341fc1e43469a50bb2e5b6b141210d40", "status:ok", "env:prod"], "points": [[10, 1]]},
+			{"metric": "my_app.requests", "tags": ["version:1.2.3", "status:error", "env:prod"], "points": [[10, 1]]},
+			{"metric": "my_app.requests", "tags": ["status:error", "env:sandbox"], "points": [[10, 1]]},
+			{"metric": "my_app.requests", "host": "tmp-1234", "tags": ["env:staging"], "points": [[10, 2]]},
+			{"metric": "my_app.requests", "host": "web-1", "tags": ["env:prod"], "points": [[10, 3]]}
+		]}`)
+		transformer.transformSeriesRequestJson(jsonDocument)
+
+		expectedOutput := parseJson(t, `{"series": [
+			{"metric": "my_app.requests", "tags": ["env:prod"], "points": [[10, 1]]},
+			{"metric": "my_app.requests", "tags": ["version:1.2.3", "status:error", "env:prod"], "points": [[10, 1]]},
+			{"metric": "my_app.requests", "tags": ["env:staging"], "points": [[10, 2]]},
+			{"metric": "my_app.requests", "host": "web-1", "tags": ["env:prod"], "points": [[10, 3]]}
+		]}`)
+		if actualOutput := parseJson(t, jsonEncode(t, jsonDocument)); !reflect.DeepEqual(expectedOutput, actualOutput) {
+			t.Errorf("Unexpected body:\n%v\nVS expected:\n%v", jsonEncode(t, actualOutput), jsonEncode(t, expectedOutput))
+		}
+	})
+
+	t.Run("it rejects invalid tag patterns", func(t *testing.T) {
+		AssertRejectsPruningConfig(t, "tags:\n  remove:\n    - metrics:\n      - '**'\n      tags:\n      - version:/^[0-9a-f/\n", 3)
+		AssertRejectsPruningConfig(t, "tags:\n  keep:\n    - metrics:\n      - '**'\n      tags:\n      - env:[prod\n", 3)
+	})
+}
+
+func TestTagAllowlists(t *testing.T) {
+	config := NewPruningConfig()
+	config.MergeWithFileOrGlob("test_fixtures/pruning_configs/tag_allowlists.yml")
+
+	t.Run("it only permits the given tags", func(t *testing.T) {
+		pruningConfig := config.ConfigFor("my_app.http.requests")
+		if expected := []string{"endpoint", "env", "security-*", "service"}; !reflect.DeepEqual(expected, pruningConfig.OnlyTags) {
+			t.Errorf("Unexpected permitted tags: %#v", pruningConfig.OnlyTags)
+		}
+		for tag, expectedRemove := range map[string]bool{
+			"env:prod":                 false,
+			"endpoint:/users":          false,
+			"security-group:sg-abcd12": false,
+			"version:1.2":              true,
+			"host":                     true,
+		} {
+			if actual := pruningConfig.RemovesTag(tag); actual != expectedRemove {
+				t.Errorf("Unexpected decision for %v: %v", tag, actual)
+			}
+		}
+		if !pruningConfig.RemoveHost || !pruningConfig.KeepHostTags {
+			t.Errorf("Expected the host to be removed and host tags to be added back: %#v", pruningConfig)
+		}
+
+		if pruningConfig := config.ConfigFor("other_app.requests"); pruningConfig.OnlyTags != nil || pruningConfig.RemovesTag("version:1.2") {
+			t.Errorf("Unexpected pruning config: %#v", pruningConfig)
+		}
+	})
+
+	t.Run("keep rules still apply", func(t *testing.T) {
+		if config.ConfigFor("my_app.special").RemovesTag("version:1.2") {
+			t.Errorf("Expected the version tag to be kept")
+		}
+
+		if pruningConfig := config.ConfigFor("my_app.with_host"); pruningConfig.RemoveHost {
+			t.Errorf("Expected the host to be kept: %#v", pruningConfig)
+		}
+	})
+
+	t.Run("it only adds back permitted host tags", func(t *testing.T) {
+		transformer := NewTransformer(config, &dummyHostTags{})
+
+		jsonDocument := parseJson(t, `{"series": [
+			{"metric": "my_app.http.requests", "host": "a", "tags": ["env:prod", "endpoint:/users", "version:1.2"], "points": [[10, 1]]},
+			{"metric": "my_app.with_host", "host": "a", "tags": ["env:prod", "version:1.2"], "points": [[10, 1]]}
+		]}`)
+		transformer.transformSeriesRequestJson(jsonDocument)
+
+		expectedOutput := normalizeSeries(parseJson(t, `{"series": [
+			{"metric": "my_app.http.requests", "tags": ["env:prod", "endpoint:/users", "security-group:sg-abcd1234", "security-group:sg-1234abcd"], "points": [[10, 1]]},
+			{"metric": "my_app.with_host", "host": "a", "tags": ["env:prod"], "points": [[10, 1]]}
+		]}`))
+		if actualOutput := normalizeSeries(parseJson(t, jsonEncode(t, jsonDocument))); !reflect.DeepEqual(expectedOutput, actualOutput) {
+			t.Errorf("Unexpected body:\n%v\nVS expected:\n%v", jsonEncode(t, actualOutput), jsonEncode(t, expectedOutput))
+		}
+	})
+
+	t.Run("it rejects tag values in allowlists", func(t *testing.T) {
+		AssertRejectsPruningConfig(t, "tags:\n  only:\n    - metrics:\n      - my_app.**\n      tags:\n      - env:prod\n", 3)
+	})
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/exec"
+	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func WithCatpuredLogging(fun func()) string {
@@ -71,6 +75,20 @@ func AssertCrashes(t *testing.T, testCaseName string, testCase func()) string {
 	return buffer.String()
 }
 
+// invalid rules should be reported along with their location, and leave the
+// pruning config untouched
+func AssertRejectsPruningConfig(t *testing.T, content string, expectedLine int) {
+	config := NewPruningConfig()
+
+	err := config.mergeWithContent([]byte(content), "invalid.yml")
+	if expectedPrefix := fmt.Sprintf("invalid.yml:%v: ", expectedLine); err == nil || !strings.HasPrefix(err.Error(), expectedPrefix) {
+		t.Errorf("Expected an error at line %v, got: %v", expectedLine, err)
+	}
+	if !reflect.DeepEqual(NewPruningConfig(), config) {
+		t.Errorf("Expected the pruning config to be left untouched")
+	}
+}
+
 func IsCircle() bool {
 	_, isCircle := os.LookupEnv("CIRCLECI")
 	return isCircle
@@ -90,3 +108,16 @@ func GetFreePort() int {
 	defer listen.Close()
 	return listen.Addr().(*net.TCPAddr).Port
 }
+
+// servers get started in goroutines, so that's how to know they're ready;
+// returns false if the port still refuses connections after a second
+func WaitForPort(port int) bool {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(port)); err == nil {
+			conn.Close()
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}